@@ -2,12 +2,17 @@ package elasticsearch
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/zond/sybutils/utils/json"
 
@@ -22,6 +27,112 @@ type ElasticConnector interface {
 	GetElasticPassword() string
 }
 
+/*
+HeaderConnector is an ElasticConnector that wants extra headers, e.g. for a proxy in front of the cluster, added to all requests.
+*/
+type HeaderConnector interface {
+	ElasticConnector
+	ExtraHeaders() http.Header
+}
+
+/*
+DefaultConnector is an ElasticConnector (and HeaderConnector) for a cluster at Service, optionally using TLSConfig to
+e.g. verify the cluster using a custom CA or authenticate using client certificates.
+*/
+type DefaultConnector struct {
+	Service   string
+	Username  string
+	Password  string
+	Headers   http.Header
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// IndexNameProcessor overrides the package IndexNameProcessor for this connector.
+	IndexNameProcessor func(s string) string
+
+	clientLock sync.Mutex
+	client     *http.Client
+}
+
+func (self *DefaultConnector) Client() *http.Client {
+	self.clientLock.Lock()
+	defer self.clientLock.Unlock()
+	if self.client == nil {
+		self.client = &http.Client{
+			Timeout: self.Timeout,
+		}
+		if self.TLSConfig != nil {
+			self.client.Transport = &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: self.TLSConfig,
+			}
+		}
+	}
+	return self.client
+}
+
+func (self *DefaultConnector) GetElasticService() string {
+	return self.Service
+}
+
+func (self *DefaultConnector) GetElasticUsername() string {
+	return self.Username
+}
+
+func (self *DefaultConnector) GetElasticPassword() string {
+	return self.Password
+}
+
+func (self *DefaultConnector) ExtraHeaders() http.Header {
+	return self.Headers
+}
+
+func (self *DefaultConnector) ProcessIndexName(s string) string {
+	if self.IndexNameProcessor != nil {
+		return self.IndexNameProcessor(s)
+	}
+	return IndexNameProcessor(s)
+}
+
+/*
+NewTLSConfig returns a TLS config trusting the PEM encoded CA certificates in caPEM (or the system CAs if empty), and
+presenting the PEM encoded client certificate and key in certPEM and keyPEM (unless empty).
+*/
+func NewTLSConfig(caPEM, certPEM, keyPEM []byte) (result *tls.Config, err error) {
+	result = &tls.Config{}
+	if len(caPEM) > 0 {
+		result.RootCAs = x509.NewCertPool()
+		if !result.RootCAs.AppendCertsFromPEM(caPEM) {
+			err = utils.Errorf("No certificates found in %#v", string(caPEM))
+			return
+		}
+	}
+	if len(certPEM) > 0 {
+		var cert tls.Certificate
+		if cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			return
+		}
+		result.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+/*
+do will authenticate request and add any extra headers of c before executing it using the client of c.
+*/
+func do(c ElasticConnector, request *http.Request) (*http.Response, error) {
+	if c.GetElasticUsername() != "" {
+		request.SetBasicAuth(c.GetElasticUsername(), c.GetElasticPassword())
+	}
+	if headerConnector, ok := c.(HeaderConnector); ok {
+		for name, values := range headerConnector.ExtraHeaders() {
+			for _, value := range values {
+				request.Header.Add(name, value)
+			}
+		}
+	}
+	return c.Client().Do(request)
+}
+
 type ElasticSearchContext interface {
 	ElasticConnector
 	Debugf(format string, args ...interface{})
@@ -29,14 +140,85 @@ type ElasticSearchContext interface {
 
 var UpdateConflictRetries = 10
 
+/*
+ESError is returned when elasticsearch responds with an unexpected status.
+*/
+type ESError struct {
+	Action     string
+	URL        string
+	StatusCode int
+	Status     string
+	// Type and Reason are parsed from the error in the response body, when elasticsearch provides them.
+	Type   string
+	Reason string
+	Body   string
+}
+
+func (self ESError) Error() string {
+	if self.Reason != "" {
+		return fmt.Sprintf("Bad status trying to %v in elasticsearch %v: %v, %v: %v", self.Action, self.URL, self.Status, self.Type, self.Reason)
+	}
+	return fmt.Sprintf("Bad status trying to %v in elasticsearch %v: %v, %v", self.Action, self.URL, self.Status, self.Body)
+}
+
+type esErrorBody struct {
+	Error *json.RawMessage `json:"error"`
+}
+
+type esErrorCause struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+/*
+newESError reads the body of response into an ESError for trying action at url.
+*/
+func newESError(action, url string, response *http.Response) (result ESError) {
+	result = ESError{
+		Action:     action,
+		URL:        url,
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+	}
+	body, _ := ioutil.ReadAll(response.Body)
+	result.Body = string(body)
+	errorBody := esErrorBody{}
+	if err := json.Unmarshal(body, &errorBody); err != nil || errorBody.Error == nil {
+		return
+	}
+	// newer versions provide an object with type and reason, older ones just a string
+	cause := esErrorCause{}
+	if err := json.Unmarshal(*errorBody.Error, &cause); err == nil {
+		result.Type, result.Reason = cause.Type, cause.Reason
+	} else {
+		json.Unmarshal(*errorBody.Error, &result.Reason)
+	}
+	return
+}
+
+var ErrVersionConflict = fmt.Errorf("Elasticsearch already had a newer version of the document")
+
 var IndexNameProcessor = func(s string) string {
 	return s
 }
 
 var legalizeRegexp = regexp.MustCompile("[^a-z0-9,]")
 
-func processIndexName(s string) string {
-	return IndexNameProcessor(legalizeRegexp.ReplaceAllString(strings.ToLower(s), ""))
+/*
+IndexNameConnector is an ElasticConnector that processes index names itself, e.g. to prefix them with a tenant or
+environment, instead of using IndexNameProcessor.
+*/
+type IndexNameConnector interface {
+	ElasticConnector
+	ProcessIndexName(s string) string
+}
+
+func processIndexName(c ElasticConnector, s string) string {
+	s = legalizeRegexp.ReplaceAllString(strings.ToLower(s), "")
+	if indexNameConnector, ok := c.(IndexNameConnector); ok {
+		return indexNameConnector.ProcessIndexName(s)
+	}
+	return IndexNameProcessor(s)
 }
 
 type IndexOption string
@@ -47,6 +229,16 @@ const (
 	NoIndex          IndexOption = "no"
 )
 
+var IndexOptions = utils.NewEnumValidator("IndexOption", string(AnalyzedIndex), string(NotAnalyzedIndex), string(NoIndex))
+
+func (self IndexOption) Validate() error {
+	return IndexOptions.Validate(string(self))
+}
+
+func (self IndexOption) MarshalJSON() ([]byte, error) {
+	return IndexOptions.Marshal(string(self))
+}
+
 type Properties struct {
 	Type     string                `json:"type"`
 	Index    IndexOption           `json:"index,omitempty"`
@@ -85,8 +277,94 @@ type Analyzer struct {
 	Filter    []string `json:"filter"`
 }
 
+/*
+MergeIndexDef returns a deep merge of base and override, without modifying either of them.
+
+Analyzers, mappings, named dynamic templates and properties present in only one of them are kept, and override wins
+when both define the same name, except that the Fields of properties defined in both are merged the same way.
+Dynamic templates keep the order of base, with templates only in override appended in their own order.
+*/
+func MergeIndexDef(base, override IndexDef) (result IndexDef) {
+	result.Template = base.Template
+	if override.Template != "" {
+		result.Template = override.Template
+	}
+	if base.Settings.Analysis.Analyzers != nil || override.Settings.Analysis.Analyzers != nil {
+		result.Settings.Analysis.Analyzers = map[string]Analyzer{}
+		for name, analyzer := range base.Settings.Analysis.Analyzers {
+			result.Settings.Analysis.Analyzers[name] = analyzer
+		}
+		for name, analyzer := range override.Settings.Analysis.Analyzers {
+			result.Settings.Analysis.Analyzers[name] = analyzer
+		}
+	}
+	if base.Mappings != nil || override.Mappings != nil {
+		result.Mappings = map[string]Mapping{}
+		for typ, mapping := range base.Mappings {
+			result.Mappings[typ] = mergeMapping(mapping, override.Mappings[typ])
+		}
+		for typ, mapping := range override.Mappings {
+			if _, found := base.Mappings[typ]; !found {
+				result.Mappings[typ] = mergeMapping(Mapping{}, mapping)
+			}
+		}
+	}
+	return
+}
+
+func mergeMapping(base, override Mapping) (result Mapping) {
+	result.Properties = mergeProperties(base.Properties, override.Properties)
+	overrides := map[string]DynamicTemplate{}
+	for _, templates := range override.DynamicTemplates {
+		for name, template := range templates {
+			overrides[name] = template
+		}
+	}
+	seen := map[string]bool{}
+	for _, templates := range base.DynamicTemplates {
+		merged := map[string]DynamicTemplate{}
+		for name, template := range templates {
+			if overridden, found := overrides[name]; found {
+				template = overridden
+			}
+			merged[name] = template
+			seen[name] = true
+		}
+		result.DynamicTemplates = append(result.DynamicTemplates, merged)
+	}
+	for _, templates := range override.DynamicTemplates {
+		added := map[string]DynamicTemplate{}
+		for name, template := range templates {
+			if !seen[name] {
+				added[name] = template
+			}
+		}
+		if len(added) > 0 {
+			result.DynamicTemplates = append(result.DynamicTemplates, added)
+		}
+	}
+	return
+}
+
+func mergeProperties(base, override map[string]Properties) (result map[string]Properties) {
+	if base == nil && override == nil {
+		return
+	}
+	result = map[string]Properties{}
+	for name, props := range base {
+		result[name] = props
+	}
+	for name, props := range override {
+		if baseProps, found := base[name]; found {
+			props.Fields = mergeProperties(baseProps.Fields, props.Fields)
+		}
+		result[name] = props
+	}
+	return
+}
+
 func CreateIndex(c ElasticConnector, name string, def IndexDef) (err error) {
-	return createIndexDef(c, "/"+processIndexName(name), def)
+	return createIndexDef(c, "/"+processIndexName(c, name), def)
 }
 
 func createIndexDef(c ElasticConnector, path string, def interface{}) (err error) {
@@ -99,16 +377,13 @@ func createIndexDef(c ElasticConnector, path string, def interface{}) (err error
 	if err != nil {
 		return
 	}
-	if c.GetElasticUsername() != "" {
-		request.SetBasicAuth(c.GetElasticUsername(), c.GetElasticPassword())
-	}
-	response, err := c.Client().Do(request)
+	response, err := do(c, request)
 	if err != nil {
 		return
 	}
 	defer response.Body.Close()
 	if response.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Bad status trying to create index template in elasticsearch %v: %v, body: %v", url, response.Status, string(b))
+		err = newESError("create index template", url, response)
 		return
 	}
 	return
@@ -130,9 +405,9 @@ func Clear(c ElasticConnector, toDelete ...string) (err error) {
 		err = fmt.Errorf("Can only give at most 2 string args to Clear")
 		return
 	} else if len(toDelete) == 2 {
-		url += fmt.Sprintf("/%v/%v", processIndexName(toDelete[0]), toDelete[1])
+		url += fmt.Sprintf("/%v/%v", processIndexName(c, toDelete[0]), toDelete[1])
 	} else if len(toDelete) == 1 {
-		url += fmt.Sprintf("/%v", processIndexName(toDelete[0]))
+		url += fmt.Sprintf("/%v", processIndexName(c, toDelete[0]))
 	} else {
 		url += "/_all"
 	}
@@ -141,26 +416,46 @@ func Clear(c ElasticConnector, toDelete ...string) (err error) {
 	if err != nil {
 		return
 	}
-	if c.GetElasticUsername() != "" {
-		request.SetBasicAuth(c.GetElasticUsername(), c.GetElasticPassword())
-	}
-	response, err := c.Client().Do(request)
+	response, err := do(c, request)
 	if err != nil {
 		return
 	}
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Bad status trying to delete from elasticsearch %v: %v", url, response.Status)
+		err = newESError("delete", url, response)
 		return
 	}
 	return
 }
 
+const (
+	// NotAnalyzedSubfield is the subfield CreateDynamicMapping indexes strings non-analyzed under.
+	NotAnalyzedSubfield = "na"
+	// LowerCaseSubfield is the subfield CreateDynamicMapping indexes strings lowercased under.
+	LowerCaseSubfield = "lower_case"
+	// LowerCaseAnalyzer is the analyzer CreateDynamicMapping uses for LowerCaseSubfield.
+	LowerCaseAnalyzer = "lower_case"
+)
+
+/*
+NotAnalyzedField returns the name of the non-analyzed subfield of the string field name.
+*/
+func NotAnalyzedField(name string) string {
+	return name + "." + NotAnalyzedSubfield
+}
+
+/*
+LowerCaseField returns the name of the lowercased subfield of the string field name.
+*/
+func LowerCaseField(name string) string {
+	return name + "." + LowerCaseSubfield
+}
+
 /*
 CreateDynamicMapping will create a sane default dynamic mapping where all
-string type fields are indexed twice, once analyzed under their proper name,
-and once non-analyzed under [name].na
+string type fields are indexed three times, once analyzed under their proper name,
+once non-analyzed under NotAnalyzedField(name), and once lowercased under LowerCaseField(name).
 */
 func CreateDynamicMapping(c ElasticConnector) (err error) {
 	indexDef := IndexDef{
@@ -169,7 +464,7 @@ func CreateDynamicMapping(c ElasticConnector) (err error) {
 		Settings: Settings{
 			Analysis: Analyzers{
 				Analyzers: map[string]Analyzer{
-					"lower_case": Analyzer{
+					LowerCaseAnalyzer: Analyzer{
 						Tokenizer: "keyword",
 						Filter:    []string{"lowercase"},
 					},
@@ -192,16 +487,16 @@ func CreateDynamicMapping(c ElasticConnector) (err error) {
 										Type:  "string",
 										Store: false,
 									},
-									"na": Properties{
+									NotAnalyzedSubfield: Properties{
 										Index: NotAnalyzedIndex,
 										Type:  "string",
 										Store: false,
 									},
-									"lower_case": Properties{
+									LowerCaseSubfield: Properties{
 										Index:    AnalyzedIndex,
 										Type:     "string",
 										Store:    false,
-										Analyzer: "lower_case",
+										Analyzer: LowerCaseAnalyzer,
 									},
 								},
 							},
@@ -218,7 +513,7 @@ func CreateDynamicMapping(c ElasticConnector) (err error) {
 }
 
 func RemoveFromIndex(c ElasticConnector, index string, source interface{}) (err error) {
-	index = processIndexName(index)
+	index = processIndexName(c, index)
 	value := reflect.ValueOf(source)
 	id := value.Elem().FieldByName("Id").Interface().(key.Key).Encode()
 
@@ -238,19 +533,130 @@ func RemoveFromIndex(c ElasticConnector, index string, source interface{}) (err
 		return
 	}
 
-	if c.GetElasticUsername() != "" {
-		request.SetBasicAuth(c.GetElasticUsername(), c.GetElasticPassword())
+	response, err := do(c, request)
+	if err != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		err = newESError("remove from index", url, response)
+		return
+	}
+	return
+}
+
+type DeleteByQueryRequest struct {
+	Query *Query `json:"query"`
+}
+
+type DeleteByQueryIndexResult struct {
+	Found   int `json:"found"`
+	Deleted int `json:"deleted"`
+	Missing int `json:"missing"`
+	Failed  int `json:"failed"`
+}
+
+type DeleteByQueryResponse struct {
+	Took    int                                 `json:"took"`
+	Indices map[string]DeleteByQueryIndexResult `json:"_indices"`
+}
+
+/*
+DeleteByQuery deletes all documents of type typ (or all types if empty) in index matching query, and returns the number
+of deleted documents.
+
+It uses the delete by query API of the ES 1.x/2.x clusters this package supports, DELETE /{index}/{type}/_query, which
+in ES 2.x requires the delete-by-query plugin. ES 1.x doesn't report how many documents were deleted, so there deleted
+will always be 0.
+*/
+func DeleteByQuery(c ElasticConnector, index, typ string, query *Query) (deleted int, err error) {
+	url := c.GetElasticService() + "/" + processIndexName(c, index)
+	if typ != "" {
+		url += "/" + typ
+	}
+	url += "/_query"
+
+	b, err := json.Marshal(DeleteByQueryRequest{
+		Query: query,
+	})
+	if err != nil {
+		return
+	}
+
+	request, err := http.NewRequest("DELETE", url, bytes.NewBuffer(b))
+	if err != nil {
+		return
 	}
-	response, err := c.Client().Do(request)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := do(c, request)
 	if err != nil {
 		return
 	}
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Bad status code from elasticsearch %v: %v", url, response.Status)
+		err = newESError("delete by query", url, response)
+		return
+	}
+
+	bodyBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return
+	}
+	result := &DeleteByQueryResponse{}
+	if err = json.Unmarshal(bodyBytes, result); err != nil {
 		return
 	}
+	deleted = result.Indices["_all"].Deleted
+	return
+}
+
+/*
+DeleteByField deletes all documents of type typ (or all types if empty) in index where field has exactly value, and
+returns the number of deleted documents.
+*/
+func DeleteByField(c ElasticConnector, index, typ, field string, value interface{}) (deleted int, err error) {
+	return DeleteByQuery(c, index, typ, NewFilterBuilder().Term(field, value).FilteredQuery(nil))
+}
+
+/*
+IndexErrors maps index names to the errors that occurred when operating on them.
+*/
+type IndexErrors map[string]error
+
+func (self IndexErrors) Error() string {
+	indices := make([]string, 0, len(self))
+	for index := range self {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	msgs := make([]string, len(indices))
+	for i, index := range indices {
+		msgs[i] = fmt.Sprintf("%v: %v", index, self[index])
+	}
+	return strings.Join(msgs, ", ")
+}
+
+/*
+DeleteByFieldInIndices runs DeleteByField against each of indices, and returns the total number of deleted documents.
+
+It continues past failing indices, and returns their errors as IndexErrors.
+*/
+func DeleteByFieldInIndices(c ElasticConnector, indices []string, typ, field string, value interface{}) (deleted int, err error) {
+	errs := IndexErrors{}
+	for _, index := range indices {
+		num, e := DeleteByField(c, index, typ, field, value)
+		if e != nil {
+			errs[index] = e
+			continue
+		}
+		deleted += num
+	}
+	if len(errs) > 0 {
+		err = errs
+	}
 	return
 }
 
@@ -260,7 +666,7 @@ type UpdateRequest struct {
 }
 
 func UpdateDoc(c ElasticConnector, index string, id key.Key, groovyCode string, params map[string]interface{}) (err error) {
-	index = processIndexName(index)
+	index = processIndexName(c, index)
 
 	url := fmt.Sprintf("%s/%s/%s/%s/_update?retry_on_conflict=%v",
 		c.GetElasticService(),
@@ -282,18 +688,14 @@ func UpdateDoc(c ElasticConnector, index string, id key.Key, groovyCode string,
 		return
 	}
 
-	if c.GetElasticUsername() != "" {
-		request.SetBasicAuth(c.GetElasticUsername(), c.GetElasticPassword())
-	}
-	response, err := c.Client().Do(request)
+	response, err := do(c, request)
 	if err != nil {
 		return
 	}
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(response.Body)
-		err = fmt.Errorf("Bad status code from elasticsearch %v: %v, %v", url, response.Status, string(body))
+		err = newESError("update document", url, response)
 		return
 	}
 	return
@@ -302,8 +704,25 @@ func UpdateDoc(c ElasticConnector, index string, id key.Key, groovyCode string,
 /*
 AddToIndex adds source to a search index.
 Source must have a field `Id *datastore.key`.
+If source has an UpdatedAt time it will be used as external version, and a newer version already in the index will
+not cause an error.
 */
 func AddToIndex(c ElasticConnector, index string, source interface{}) (err error) {
+	return AddToIndexWithOptions(c, index, source, AddToIndexOptions{})
+}
+
+/*
+AddToIndexOptions configures AddToIndexWithOptions.
+*/
+type AddToIndexOptions struct {
+	// ReportConflicts makes a newer version of the document already in the index cause ErrVersionConflict instead of success.
+	ReportConflicts bool
+}
+
+/*
+AddToIndexWithOptions adds source to a search index like AddToIndex, configured by opts.
+*/
+func AddToIndexWithOptions(c ElasticConnector, index string, source interface{}, opts AddToIndexOptions) (err error) {
 	sourceVal := reflect.ValueOf(source)
 	if sourceVal.Kind() != reflect.Ptr {
 		err = fmt.Errorf("%#v is not a pointer", source)
@@ -313,7 +732,7 @@ func AddToIndex(c ElasticConnector, index string, source interface{}) (err error
 		err = fmt.Errorf("%#v is not a pointer to a struct", source)
 		return
 	}
-	index = processIndexName(index)
+	index = processIndexName(c, index)
 
 	value := reflect.ValueOf(source).Elem()
 	id := value.FieldByName("Id").Interface().(key.Key).Encode()
@@ -346,18 +765,18 @@ func AddToIndex(c ElasticConnector, index string, source interface{}) (err error
 		return
 	}
 
-	if c.GetElasticUsername() != "" {
-		request.SetBasicAuth(c.GetElasticUsername(), c.GetElasticPassword())
-	}
-	response, err := c.Client().Do(request)
+	response, err := do(c, request)
 	if err != nil {
 		return
 	}
 	defer response.Body.Close()
 
+	if response.StatusCode == http.StatusConflict && opts.ReportConflicts {
+		err = ErrVersionConflict
+		return
+	}
 	if response.StatusCode != http.StatusCreated && response.StatusCode != http.StatusOK && response.StatusCode != http.StatusConflict {
-		body, _ := ioutil.ReadAll(response.Body)
-		err = fmt.Errorf("Bad status code from elasticsearch %v: %v, %v", url, response.Status, string(body))
+		err = newESError("add to index", url, response)
 		return
 	}
 	return
@@ -453,12 +872,44 @@ type Hits struct {
 	Hits     []ElasticDoc `json:"hits"`
 }
 
+/*
+AggregationResult is the result of an aggregation.
+
+Both the legacy envelope, with the buckets nested in a "termcount" sub aggregation, and the current one, with the buckets
+directly in the aggregation, are decoded into TermCount.
+*/
 type AggregationResult struct {
 	Value     int                        `json:"value,omitempty"`
 	DocCount  int                        `json:"doc_count,omitempty"`
 	TermCount AggregationTermCountResult `json:"termcount,omitempty"`
 }
 
+type aggregationEnvelope struct {
+	Value     *float64                     `json:"value"`
+	DocCount  int                          `json:"doc_count"`
+	TermCount AggregationTermCountResult   `json:"termcount"`
+	Buckets   []AggregationTermCountBucket `json:"buckets"`
+}
+
+func (self *AggregationResult) UnmarshalJSON(b []byte) (err error) {
+	envelope := aggregationEnvelope{}
+	if err = json.Unmarshal(b, &envelope); err != nil {
+		return
+	}
+	*self = AggregationResult{
+		DocCount:  envelope.DocCount,
+		TermCount: envelope.TermCount,
+	}
+	// values may be floats, or null for empty aggregations
+	if envelope.Value != nil {
+		self.Value = int(*envelope.Value)
+	}
+	if len(self.TermCount.Buckets) == 0 && len(envelope.Buckets) > 0 {
+		self.TermCount.Buckets = envelope.Buckets
+	}
+	return
+}
+
 type AggregationTermCountResult struct {
 	Buckets []AggregationTermCountBucket `json:"buckets"`
 }
@@ -468,6 +919,29 @@ type AggregationTermCountBucket struct {
 	Key      string `json:"key"`
 }
 
+type aggregationBucketEnvelope struct {
+	DocCount    int             `json:"doc_count"`
+	Key         json.RawMessage `json:"key"`
+	KeyAsString string          `json:"key_as_string"`
+}
+
+/*
+UnmarshalJSON accepts numeric keys, which the current envelope uses for numeric fields, using key_as_string if present.
+*/
+func (self *AggregationTermCountBucket) UnmarshalJSON(b []byte) (err error) {
+	envelope := aggregationBucketEnvelope{}
+	if err = json.Unmarshal(b, &envelope); err != nil {
+		return
+	}
+	self.DocCount = envelope.DocCount
+	if envelope.KeyAsString != "" {
+		self.Key = envelope.KeyAsString
+	} else if err = json.Unmarshal(envelope.Key, &self.Key); err != nil {
+		self.Key, err = string(envelope.Key), nil
+	}
+	return
+}
+
 type SearchResponse struct {
 	Took         float64                      `json:"took"`
 	Hits         Hits                         `json:"hits"`
@@ -477,6 +951,52 @@ type SearchResponse struct {
 	Aggregations map[string]AggregationResult `json:"aggregations,omitempty"`
 }
 
+/*
+resultItems returns the struct result points to, and its Items slice, or an error if result doesn't look like that.
+*/
+func resultItems(result interface{}) (resultValue, items reflect.Value, err error) {
+	resultValue = reflect.ValueOf(result)
+	for resultValue.Kind() == reflect.Ptr && !resultValue.IsNil() {
+		resultValue = resultValue.Elem()
+	}
+	if resultValue.Kind() != reflect.Struct || !resultValue.CanAddr() {
+		err = fmt.Errorf("%#v is not a pointer to a struct", result)
+		return
+	}
+	if items = resultValue.FieldByName("Items"); !items.IsValid() || items.Kind() != reflect.Slice {
+		err = fmt.Errorf("%#v doesn't have an Items slice", result)
+		return
+	}
+	return
+}
+
+/*
+searchType returns the document type to search for to fill the Items slice of result, or an empty string to search all types
+if the Items are interface{}.
+*/
+func searchType(result interface{}) (typ string, err error) {
+	_, items, err := resultItems(result)
+	if err != nil {
+		return
+	}
+	elemType := items.Type().Elem()
+	for elemType.Kind() == reflect.Ptr {
+		elemType = elemType.Elem()
+	}
+	if elemType.Kind() == reflect.Interface {
+		return
+	}
+	if typ = elemType.Name(); typ == "" {
+		err = fmt.Errorf("Unable to determine document type of the Items of %#v", result)
+	}
+	return
+}
+
+/*
+Copy will copy the sources of the hits into the Items of result, along with the Total, Page and PerPage.
+
+Items of type interface{} will get the raw source maps.
+*/
 func (self *SearchResponse) Copy(result interface{}) (err error) {
 	sources := make(Sources, len(self.Hits.Hits))
 	for index, hit := range self.Hits.Hits {
@@ -486,11 +1006,11 @@ func (self *SearchResponse) Copy(result interface{}) (err error) {
 	if err != nil {
 		return
 	}
-	resultValue := reflect.ValueOf(result).Elem()
-	for resultValue.Kind() == reflect.Ptr {
-		resultValue = resultValue.Elem()
+	resultValue, items, err := resultItems(result)
+	if err != nil {
+		return
 	}
-	if err = json.Unmarshal(buf, resultValue.FieldByName("Items").Addr().Interface()); err != nil {
+	if err = json.Unmarshal(buf, items.Addr().Interface()); err != nil {
 		return
 	}
 	resultValue.FieldByName("Total").Set(reflect.ValueOf(self.Hits.Total))
@@ -553,8 +1073,112 @@ type RangeDef struct {
 	Boost string `json:"boost,omitempty"`
 }
 
+/*
+TermFilter returns a Filter matching documents where field has exactly value.
+*/
+func TermFilter(field string, value interface{}) Filter {
+	return Filter{Term: map[string]interface{}{field: value}}
+}
+
+/*
+RangeFilter returns a Filter matching documents where field is within r.
+*/
+func RangeFilter(field string, r RangeDef) Filter {
+	return Filter{Range: map[string]RangeDef{field: r}}
+}
+
+/*
+NewMissingFilter returns a Filter matching documents without field.
+*/
+func NewMissingFilter(field string) Filter {
+	return Filter{Missing: &MissingFilter{Field: field}}
+}
+
+/*
+FilterBuilder builds a bool Filter where all added clauses must match.
+*/
+type FilterBuilder struct {
+	bool BoolFilter
+}
+
+/*
+NewFilterBuilder returns an empty FilterBuilder, building a Filter matching everything.
+*/
+func NewFilterBuilder() *FilterBuilder {
+	return &FilterBuilder{}
+}
+
+/*
+And requires all filters to match.
+*/
+func (self *FilterBuilder) And(filters ...Filter) *FilterBuilder {
+	self.bool.Must = append(self.bool.Must, filters...)
+	return self
+}
+
+/*
+Or requires at least one of filters to match.
+*/
+func (self *FilterBuilder) Or(filters ...Filter) *FilterBuilder {
+	return self.And(Filter{Bool: &BoolFilter{Should: filters}})
+}
+
+/*
+Not requires none of filters to match.
+*/
+func (self *FilterBuilder) Not(filters ...Filter) *FilterBuilder {
+	self.bool.MustNot = append(self.bool.MustNot, filters...)
+	return self
+}
+
+/*
+Term requires field to have exactly value.
+*/
+func (self *FilterBuilder) Term(field string, value interface{}) *FilterBuilder {
+	return self.And(TermFilter(field, value))
+}
+
+/*
+Range requires field to be within r.
+*/
+func (self *FilterBuilder) Range(field string, r RangeDef) *FilterBuilder {
+	return self.And(RangeFilter(field, r))
+}
+
+/*
+Missing requires field to be missing.
+*/
+func (self *FilterBuilder) Missing(field string) *FilterBuilder {
+	return self.And(NewMissingFilter(field))
+}
+
+/*
+Filter returns the built Filter.
+*/
+func (self *FilterBuilder) Filter() *Filter {
+	result := self.bool
+	return &Filter{Bool: &result}
+}
+
+/*
+FilteredQuery returns a Query filtering the results of query (or all documents if nil) with the built Filter.
+*/
+func (self *FilterBuilder) FilteredQuery(query *Query) *Query {
+	if query == nil {
+		query = &Query{MatchAll: &MatchAllQuery{}}
+	}
+	return &Query{Filtered: &FilteredQuery{Query: query, Filter: self.Filter()}}
+}
+
+/*
+SearchAndCopy will search for documents of the type of the Items of result, or all types if they are interface{}, and Copy
+the response into result.
+*/
 func SearchAndCopy(c ElasticSearchContext, query *SearchRequest, index string, result interface{}) (err error) {
-	name := reflect.ValueOf(result).Elem().FieldByName("Items").Type().Elem().Name()
+	name, err := searchType(result)
+	if err != nil {
+		return
+	}
 	response, err := Search(c, query, index, name)
 	if err != nil {
 		return
@@ -569,7 +1193,7 @@ func Search(c ElasticSearchContext, query *SearchRequest, index, typ string) (re
 	if query.Size == 0 {
 		query.Size = 10
 	}
-	index = processIndexName(index)
+	index = processIndexName(c, index)
 
 	url := c.GetElasticService()
 	if index == "" {
@@ -592,18 +1216,14 @@ func Search(c ElasticSearchContext, query *SearchRequest, index, typ string) (re
 		return
 	}
 
-	if c.GetElasticUsername() != "" {
-		request.SetBasicAuth(c.GetElasticUsername(), c.GetElasticPassword())
-	}
-
-	response, err := c.Client().Do(request)
+	response, err := do(c, request)
 	if err != nil {
 		return
 	}
 	defer response.Body.Close()
 
 	if response.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Bad status trying to search in elasticsearch %v: %v", url, response.Status)
+		err = newESError("search", url, response)
 		return
 	}
 
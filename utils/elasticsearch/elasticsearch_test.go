@@ -0,0 +1,269 @@
+package elasticsearch
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kr/pretty"
+	"github.com/zond/sybutils/utils/json"
+)
+
+type testDoc struct {
+	Name string
+}
+
+type testDocs struct {
+	Items   []testDoc
+	Total   int
+	Page    int
+	PerPage int
+}
+
+type testInterfaces struct {
+	Items   []interface{}
+	Total   int
+	Page    int
+	PerPage int
+}
+
+func TestSearchType(t *testing.T) {
+	if typ, err := searchType(&testDocs{}); err != nil || typ != "testDoc" {
+		t.Errorf("Wanted testDoc, got %#v, %v", typ, err)
+	}
+	if typ, err := searchType(&testInterfaces{}); err != nil || typ != "" {
+		t.Errorf("Wanted no type, got %#v, %v", typ, err)
+	}
+	if _, err := searchType(&struct{ Items []struct{} }{}); err == nil {
+		t.Errorf("Wanted an error for anonymous Items")
+	}
+	if _, err := searchType(&testDoc{}); err == nil {
+		t.Errorf("Wanted an error for missing Items")
+	}
+}
+
+func TestCopyToInterfaces(t *testing.T) {
+	name := json.RawMessage(`"a"`)
+	response := &SearchResponse{
+		Hits: Hits{
+			Total: 1,
+			Hits: []ElasticDoc{
+				{Source: map[string]*json.RawMessage{"Name": &name}},
+			},
+		},
+	}
+	result := &testInterfaces{}
+	if err := response.Copy(result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Items) != 1 || result.Total != 1 {
+		t.Fatalf("Wanted one item, got %+v", result)
+	}
+	if source, ok := result.Items[0].(map[string]interface{}); !ok || source["Name"] != "a" {
+		t.Errorf("Wanted the raw source, got %#v", result.Items[0])
+	}
+}
+
+func TestFilterBuilder(t *testing.T) {
+	filter := NewFilterBuilder().
+		Term("kind", "a").
+		Range("age", RangeDef{Gte: "1"}).
+		Or(TermFilter("color", "red"), NewMissingFilter("color")).
+		Not(TermFilter("deleted", true)).
+		Filter()
+	b, err := json.Marshal(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := `{"bool":{"must":[{"term":{"kind":"a"}},{"range":{"age":{"gte":"1"}}},{"bool":{"should":[{"term":{"color":"red"}},{"missing":{"field":"color"}}]}}],"must_not":[{"term":{"deleted":true}}]}}`
+	if string(b) != wanted {
+		t.Errorf("Wanted %v, got %s", wanted, b)
+	}
+}
+
+func TestAggregationEnvelopes(t *testing.T) {
+	for _, body := range []string{
+		`{"aggregations":{"colors":{"doc_count":3,"termcount":{"buckets":[{"key":"red","doc_count":2},{"key":1,"doc_count":1}]}}}}`,
+		`{"aggregations":{"colors":{"doc_count":3,"buckets":[{"key":"red","doc_count":2},{"key":1,"doc_count":1}]}}}`,
+	} {
+		response := &SearchResponse{}
+		if err := json.Unmarshal([]byte(body), response); err != nil {
+			t.Fatal(err)
+		}
+		buckets := response.Aggregations["colors"].TermCount.Buckets
+		if response.Aggregations["colors"].DocCount != 3 || len(buckets) != 2 || buckets[0].Key != "red" || buckets[1].Key != "1" || buckets[1].DocCount != 1 {
+			t.Errorf("Wrong aggregations decoded from %v: %+v", body, response.Aggregations)
+		}
+	}
+}
+
+func TestESError(t *testing.T) {
+	for _, body := range []string{
+		`{"error":{"type":"index_not_found_exception","reason":"no such index"},"status":404}`,
+		`{"error":"IndexMissingException[no such index]","status":404}`,
+	} {
+		err := newESError("search", "http://localhost/x/_search", &http.Response{
+			StatusCode: 404,
+			Status:     "404 Not Found",
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		})
+		if err.StatusCode != 404 || err.Body != body || !strings.Contains(err.Reason, "no such index") {
+			t.Errorf("Wrong ESError parsed from %v: %+v", body, err)
+		}
+	}
+}
+
+func TestMergeIndexDefAnalyzers(t *testing.T) {
+	base := IndexDef{
+		Template: "*",
+		Settings: Settings{
+			Analysis: Analyzers{
+				Analyzers: map[string]Analyzer{
+					"lower":   Analyzer{Tokenizer: "keyword", Filter: []string{"lowercase"}},
+					"default": Analyzer{Tokenizer: "standard"},
+				},
+			},
+		},
+	}
+	override := IndexDef{
+		Settings: Settings{
+			Analysis: Analyzers{
+				Analyzers: map[string]Analyzer{
+					"default": Analyzer{Tokenizer: "whitespace"},
+					"ascii":   Analyzer{Tokenizer: "standard", Filter: []string{"asciifolding"}},
+				},
+			},
+		},
+	}
+	merged := MergeIndexDef(base, override)
+	wanted := map[string]Analyzer{
+		"lower":   Analyzer{Tokenizer: "keyword", Filter: []string{"lowercase"}},
+		"default": Analyzer{Tokenizer: "whitespace"},
+		"ascii":   Analyzer{Tokenizer: "standard", Filter: []string{"asciifolding"}},
+	}
+	if !reflect.DeepEqual(merged.Settings.Analysis.Analyzers, wanted) {
+		t.Errorf("Wanted %+v, got %+v", wanted, merged.Settings.Analysis.Analyzers)
+	}
+	if merged.Template != "*" {
+		t.Errorf("Wanted the base template, got %#v", merged.Template)
+	}
+	if base.Settings.Analysis.Analyzers["default"].Tokenizer != "standard" {
+		t.Errorf("MergeIndexDef modified base")
+	}
+}
+
+func TestMergeIndexDefProperties(t *testing.T) {
+	base := IndexDef{
+		Mappings: map[string]Mapping{
+			"Doc": Mapping{
+				DynamicTemplates: []map[string]DynamicTemplate{
+					{"strings": DynamicTemplate{Match: "*", MatchMappingType: "string"}},
+					{"longs": DynamicTemplate{Match: "*", MatchMappingType: "long"}},
+				},
+				Properties: map[string]Properties{
+					"Name": Properties{
+						Type: "string",
+						Fields: map[string]Properties{
+							"raw": Properties{Type: "string", Index: NotAnalyzedIndex},
+						},
+					},
+					"Age": Properties{Type: "long"},
+				},
+			},
+		},
+	}
+	override := IndexDef{
+		Mappings: map[string]Mapping{
+			"Doc": Mapping{
+				DynamicTemplates: []map[string]DynamicTemplate{
+					{"dates": DynamicTemplate{Match: "*At", MatchMappingType: "date"}},
+					{"strings": DynamicTemplate{Match: "*", MatchMappingType: "string", Mapping: &Properties{Type: "string"}}},
+				},
+				Properties: map[string]Properties{
+					"Name": Properties{
+						Type:     "string",
+						Analyzer: "lower",
+						Fields: map[string]Properties{
+							"lower": Properties{Type: "string", Analyzer: "lower"},
+						},
+					},
+					"Email": Properties{Type: "string", Index: NotAnalyzedIndex},
+				},
+			},
+			"Other": Mapping{
+				Properties: map[string]Properties{
+					"Id": Properties{Type: "string"},
+				},
+			},
+		},
+	}
+	merged := MergeIndexDef(base, override)
+	wanted := map[string]Mapping{
+		"Doc": Mapping{
+			DynamicTemplates: []map[string]DynamicTemplate{
+				{"strings": DynamicTemplate{Match: "*", MatchMappingType: "string", Mapping: &Properties{Type: "string"}}},
+				{"longs": DynamicTemplate{Match: "*", MatchMappingType: "long"}},
+				{"dates": DynamicTemplate{Match: "*At", MatchMappingType: "date"}},
+			},
+			Properties: map[string]Properties{
+				"Name": Properties{
+					Type:     "string",
+					Analyzer: "lower",
+					Fields: map[string]Properties{
+						"raw":   Properties{Type: "string", Index: NotAnalyzedIndex},
+						"lower": Properties{Type: "string", Analyzer: "lower"},
+					},
+				},
+				"Age":   Properties{Type: "long"},
+				"Email": Properties{Type: "string", Index: NotAnalyzedIndex},
+			},
+		},
+		"Other": Mapping{
+			Properties: map[string]Properties{
+				"Id": Properties{Type: "string"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(merged.Mappings, wanted) {
+		t.Errorf("Wanted %# v, got %# v", pretty.Formatter(wanted), pretty.Formatter(merged.Mappings))
+	}
+	if len(base.Mappings["Doc"].Properties["Name"].Fields) != 1 {
+		t.Errorf("MergeIndexDef modified base")
+	}
+}
+
+func TestDeleteByFieldInIndices(t *testing.T) {
+	bodies := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			t.Errorf("Wanted DELETE, got %v", r.Method)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies[r.URL.Path] = string(b)
+		switch r.URL.Path {
+		case "/a/Doc/_query":
+			w.Write([]byte(`{"took":1,"_indices":{"_all":{"found":3,"deleted":3,"missing":0,"failed":0},"a":{"found":3,"deleted":3,"missing":0,"failed":0}}}`))
+		case "/b/Doc/_query":
+			w.Write([]byte(`{"took":1,"_indices":{"_all":{"found":2,"deleted":2,"missing":0,"failed":0},"b":{"found":2,"deleted":2,"missing":0,"failed":0}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"type":"index_not_found_exception","reason":"no such index"}}`))
+		}
+	}))
+	defer server.Close()
+	c := &DefaultConnector{Service: server.URL}
+	deleted, err := DeleteByFieldInIndices(c, []string{"a", "missing", "b"}, "Doc", "Account", "acc1")
+	if deleted != 5 {
+		t.Errorf("Wanted 5 deleted, got %v", deleted)
+	}
+	indexErrors, ok := err.(IndexErrors)
+	if !ok || len(indexErrors) != 1 || indexErrors["missing"] == nil {
+		t.Errorf("Wanted an error for the missing index, got %#v", err)
+	}
+	if !strings.Contains(bodies["/a/Doc/_query"], `{"term":{"Account":"acc1"}}`) {
+		t.Errorf("Wanted a term filter on Account, got %v", bodies["/a/Doc/_query"])
+	}
+}
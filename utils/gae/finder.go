@@ -18,6 +18,8 @@ type finder struct {
 	fields []reflect.StructField
 	model  interface{}
 	typ    string
+	// uncached is true if any of the fields are tagged `consistency:"eventual"`, and makes the finder skip memcache even with an ancestor.
+	uncached bool
 }
 
 // registeredFinders is used to find what cache keys to invalidate when a model is CRUDed.
@@ -39,6 +41,11 @@ func newFinder(finderType string, model interface{}, register bool, fields ...st
 		model:  model,
 		typ:    finderType,
 	}
+	for _, field := range structFields {
+		if field.Tag.Get("consistency") == "eventual" {
+			result.uncached = true
+		}
+	}
 	if register {
 		name := reflect.TypeOf(model).Elem().Name()
 		registeredFinders[name] = append(registeredFinders[name], result)
@@ -60,12 +67,29 @@ AncestorFinder will return a finder function that memoizes running a datastore q
 
 It will also register the finder so that MemcacheKeys will return keys to invalidate the result each time a matching model is CRUDed.
 
+If any of the fields are tagged `consistency:"eventual"`, the query will never be memoized, to avoid caching stale results
+right after a write.
+
 The returned function will set the Id field of all found models, and call their AfterLoad functions if any.
 */
 func AncestorFinder(model interface{}, fields ...string) func(c PersistenceContext, dst interface{}, ancestor key.Key, values ...interface{}) error {
 	return newFinder("get", model, true, fields...).getWithAncestor
 }
 
+/*
+PagedAncestorFinder will return a finder function that runs a datastore query for at most limit matching models, starting
+at cursor, and returns the cursor of the next page, or "" if there are no more matches. The models replace the contents
+of dst, and limit must be at least 1.
+
+Unlike AncestorFinder the query is never memoized, since partial pages aren't meaningfully cacheable, which makes it suitable
+for jobs that need to resume or stream scans over large ancestor sets.
+
+The returned function will set the Id field of all found models, and call their AfterLoad functions if any.
+*/
+func PagedAncestorFinder(model interface{}, fields ...string) func(c PersistenceContext, dst interface{}, ancestor key.Key, cursor string, limit int, values ...interface{}) (next string, err error) {
+	return newFinder("page", model, false, fields...).getPage
+}
+
 func Counter(model interface{}, fields ...string) func(c PersistenceContext, values ...interface{}) (int, error) {
 	return newFinder("count", model, false, fields...).count
 }
@@ -74,45 +98,100 @@ func AncestorCounter(model interface{}, fields ...string) func(c PersistenceCont
 	return newFinder("count", model, true, fields...).countWithAncestor
 }
 
-// find runs a datastore query, if ancestor != nil an ancestor query, and sets the id of all found models.
-func (self finder) find(c PersistenceContext, dst interface{}, ancestor key.Key, values []interface{}) (err error) {
-	q := datastore.NewQuery(reflect.TypeOf(self.model).Elem().Name())
+// query returns a datastore query, if ancestor != nil an ancestor query, for models matching values.
+func (self finder) query(c PersistenceContext, ancestor key.Key, values []interface{}) (q *datastore.Query) {
+	q = datastore.NewQuery(reflect.TypeOf(self.model).Elem().Name())
 	if ancestor != "" {
 		q = q.Ancestor(gaekey.ToGAE(c, ancestor))
 	}
 	for index, value := range values {
 		q = q.Filter(fmt.Sprintf("%v=", self.fields[index].Name), value)
 	}
+	return
+}
+
+// find runs a datastore query, if ancestor != nil an ancestor query, and sets the id of all found models.
+func (self finder) find(c PersistenceContext, dst interface{}, ancestor key.Key, values []interface{}) (err error) {
 	var ids []*datastore.Key
-	ids, err = q.GetAll(c, dst)
+	ids, err = self.query(c, ancestor, values).GetAll(c, dst)
 	if err = FilterOkErrors(err); err != nil {
 		return
 	}
+	return setIds(dst, ids)
+}
+
+// findPage replaces the contents of dst with at most limit models starting at cursor, sets the id of all found models and returns the next cursor.
+func (self finder) findPage(c PersistenceContext, dst interface{}, ancestor key.Key, cursor string, limit int, values []interface{}) (next string, err error) {
+	if limit < 1 {
+		err = utils.Errorf("Paged finder needs a limit of at least 1, but got %v", limit)
+		return
+	}
+	q := self.query(c, ancestor, values).Limit(limit)
+	if cursor != "" {
+		var start datastore.Cursor
+		if start, err = datastore.DecodeCursor(cursor); err != nil {
+			return
+		}
+		q = q.Start(start)
+	}
+	dstVal := reflect.ValueOf(dst).Elem()
+	dstVal.SetLen(0)
+	elemType := dstVal.Type().Elem()
+	ids := []*datastore.Key{}
+	t := q.Run(c)
+	for {
+		var element reflect.Value
+		if elemType.Kind() == reflect.Ptr {
+			element = reflect.New(elemType.Elem())
+		} else {
+			element = reflect.New(elemType)
+		}
+		var id *datastore.Key
+		id, err = t.Next(element.Interface())
+		if err == datastore.Done {
+			err = nil
+			break
+		}
+		if err = FilterOkErrors(err); err != nil {
+			return
+		}
+		if elemType.Kind() != reflect.Ptr {
+			element = element.Elem()
+		}
+		dstVal.Set(reflect.Append(dstVal, element))
+		ids = append(ids, id)
+	}
+	if len(ids) == limit {
+		var end datastore.Cursor
+		if end, err = t.Cursor(); err != nil {
+			return
+		}
+		next = end.String()
+	}
+	err = setIds(dst, ids)
+	return
+}
+
+// setIds sets the Id field of the models in the slice pointed to by dst to ids.
+func setIds(dst interface{}, ids []*datastore.Key) (err error) {
+	var ks []key.Key
+	if ks, err = gaekey.FromGAEMulti(ids); err != nil {
+		return
+	}
 	dstElem := reflect.ValueOf(dst).Elem()
 	var element reflect.Value
-	for index, id := range ids {
+	for index, k := range ks {
 		element = dstElem.Index(index)
 		if element.Kind() == reflect.Ptr {
 			element = element.Elem()
 		}
-		var k key.Key
-		if k, err = gaekey.FromGAE(id); err != nil {
-			return
-		}
 		element.FieldByName(idFieldName).Set(reflect.ValueOf(k))
 	}
 	return
 }
 
 func (self finder) getCount(c PersistenceContext, ancestor key.Key, values []interface{}) (result int, err error) {
-	q := datastore.NewQuery(reflect.TypeOf(self.model).Elem().Name())
-	if ancestor != "" {
-		q = q.Ancestor(gaekey.ToGAE(c, ancestor))
-	}
-	for index, value := range values {
-		q = q.Filter(fmt.Sprintf("%v=", self.fields[index].Name), value)
-	}
-	result, err = q.Count(c)
+	result, err = self.query(c, ancestor, values).Count(c)
 	if err = FilterOkErrors(err); err != nil {
 		return
 	}
@@ -167,8 +246,8 @@ func (self finder) countWithAncestor(c PersistenceContext, ancestor key.Key, val
 		return
 	}
 	// We can't really cache finders that don't use ancestor fields, since they are eventually consistent which might fill the cache with inconsistent data
-	if ancestor == "" {
-		if result, err = self.getCount(c, "", values); err != nil {
+	if ancestor == "" || self.uncached {
+		if result, err = self.getCount(c, ancestor, values); err != nil {
 			return
 		}
 	} else {
@@ -189,8 +268,8 @@ func (self finder) countWithAncestor(c PersistenceContext, ancestor key.Key, val
 	return
 }
 
-// see AncestorFinder
-func (self finder) getWithAncestor(c PersistenceContext, dst interface{}, ancestor key.Key, values ...interface{}) (err error) {
+// checkValues returns an error unless values match the fields of the finder.
+func (self finder) checkValues(values []interface{}) (err error) {
 	if len(values) != len(self.fields) {
 		wantedTypeNames := []string{}
 		for _, field := range self.fields {
@@ -201,11 +280,30 @@ func (self finder) getWithAncestor(c PersistenceContext, dst interface{}, ancest
 			givenTypeNames = append(givenTypeNames, reflect.TypeOf(val).Name())
 		}
 		err = utils.Errorf("Finder wants %+v as arguments, but got %+v", wantedTypeNames, givenTypeNames)
+	}
+	return
+}
+
+// see PagedAncestorFinder
+func (self finder) getPage(c PersistenceContext, dst interface{}, ancestor key.Key, cursor string, limit int, values ...interface{}) (next string, err error) {
+	if err = self.checkValues(values); err != nil {
+		return
+	}
+	if next, err = self.findPage(c, dst, ancestor, cursor, limit, values); err != nil {
+		return
+	}
+	err = afterLoadAll(c, dst)
+	return
+}
+
+// see AncestorFinder
+func (self finder) getWithAncestor(c PersistenceContext, dst interface{}, ancestor key.Key, values ...interface{}) (err error) {
+	if err = self.checkValues(values); err != nil {
 		return
 	}
 	// We can't really cache finders that don't use ancestor fields, since they are eventually consistent which might fill the cache with inconsistent data
-	if ancestor == "" {
-		if err = self.find(c, dst, "", values); err != nil {
+	if ancestor == "" || self.uncached {
+		if err = self.find(c, dst, ancestor, values); err != nil {
 			return
 		}
 	} else {
@@ -218,6 +316,11 @@ func (self finder) getWithAncestor(c PersistenceContext, dst interface{}, ancest
 			return
 		}
 	}
+	return afterLoadAll(c, dst)
+}
+
+// afterLoadAll runs the AfterLoad functions, if any, of all models in the slice pointed to by dst.
+func afterLoadAll(c PersistenceContext, dst interface{}) (err error) {
 	val := reflect.ValueOf(dst).Elem()
 	errors := appengine.MultiError{}
 	for i := 0; i < val.Len(); i++ {
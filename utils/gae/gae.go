@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -24,6 +25,24 @@ const (
 	idFieldName = "Id"
 )
 
+/*
+EntityGroupTracker is implemented by contexts that want to validate the entity groups written to in a transaction,
+to be able to fail with a clearer error than datastore does.
+*/
+type EntityGroupTracker interface {
+	TrackEntityGroups(ids ...key.Key) error
+}
+
+/*
+trackEntityGroups will let c track the entity groups of ids if c is an EntityGroupTracker in a transaction.
+*/
+func trackEntityGroups(c PersistenceContext, ids ...key.Key) error {
+	if tracker, ok := c.(EntityGroupTracker); ok && c.InTransaction() {
+		return tracker.TrackEntityGroups(ids...)
+	}
+	return nil
+}
+
 func GetKinds(c context.Context) (result []string, err error) {
 	ids, err := datastore.NewQuery("__Stat_Kind__").KeysOnly().GetAll(c, nil)
 	if err != nil {
@@ -67,11 +86,65 @@ type LogStats struct {
 	TotalLatency time.Duration
 	MaxLatency   time.Duration
 	MinLatency   time.Duration
+	P50Latency   time.Duration
+	P95Latency   time.Duration
+	P99Latency   time.Duration
 	TotalCost    float64
 	MaxCost      float64
 	MinCost      float64
 }
 
+/*
+LogRecords lazily iterates over the App Engine log records returned by GetLogRecords.
+*/
+type LogRecords struct {
+	result *log.Result
+	filter func(rec *log.Record) bool
+}
+
+/*
+Next returns the next record accepted by the filter, or log.Done when there are no more records.
+*/
+func (self *LogRecords) Next() (rec *log.Record, err error) {
+	for rec, err = self.result.Next(); err == nil; rec, err = self.result.Next() {
+		if self.filter == nil || self.filter(rec) {
+			return
+		}
+	}
+	return
+}
+
+/*
+GetLogRecords returns the log records between from and to for which filter returns true, or all of them if filter is nil.
+
+The records are fetched lazily as Next is called.
+*/
+func GetLogRecords(c context.Context, from, to time.Time, filter func(rec *log.Record) bool) *LogRecords {
+	query := &log.Query{StartTime: from, EndTime: to}
+	return &LogRecords{
+		result: query.Run(c),
+		filter: filter,
+	}
+}
+
+type latenciesByDuration []time.Duration
+
+func (self latenciesByDuration) Len() int           { return len(self) }
+func (self latenciesByDuration) Less(i, j int) bool { return self[i] < self[j] }
+func (self latenciesByDuration) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+// percentile returns the nearest rank percentile p of the sorted latencies.
+func (self latenciesByDuration) percentile(p int) time.Duration {
+	if len(self) == 0 {
+		return 0
+	}
+	rank := (p*len(self) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return self[rank-1]
+}
+
 func GetLogStats(c context.Context, from, to time.Time, max int, includeDelayTasks bool) (result *LogStats) {
 	result = &LogStats{
 		Statuses: StatusMap{},
@@ -79,31 +152,36 @@ func GetLogStats(c context.Context, from, to time.Time, max int, includeDelayTas
 		To:       to,
 		Max:      max,
 	}
-	query := &log.Query{StartTime: from, EndTime: to}
-	res := query.Run(c)
-	for rec, err := res.Next(); err == nil; rec, err = res.Next() {
-		if includeDelayTasks || rec.Resource != "/_ah/queue/go/delay" {
-			result.Records++
-			result.Statuses[rec.Status]++
-			result.TotalLatency += rec.Latency
-			if result.MaxLatency == 0 || rec.Latency > result.MaxLatency {
-				result.MaxLatency = rec.Latency
-			}
-			if result.MinLatency == 0 || rec.Latency < result.MinLatency {
-				result.MinLatency = rec.Latency
-			}
-			result.TotalCost += rec.Cost
-			if result.MaxCost == 0 || rec.Cost > result.MaxCost {
-				result.MaxCost = rec.Cost
-			}
-			if result.MinCost == 0 || rec.Cost < result.MinCost {
-				result.MinCost = rec.Cost
-			}
-			if result.Records >= max {
-				break
-			}
+	records := GetLogRecords(c, from, to, func(rec *log.Record) bool {
+		return includeDelayTasks || rec.Resource != "/_ah/queue/go/delay"
+	})
+	latencies := latenciesByDuration{}
+	for rec, err := records.Next(); err == nil; rec, err = records.Next() {
+		result.Records++
+		result.Statuses[rec.Status]++
+		result.TotalLatency += rec.Latency
+		latencies = append(latencies, rec.Latency)
+		if result.MaxLatency == 0 || rec.Latency > result.MaxLatency {
+			result.MaxLatency = rec.Latency
+		}
+		if result.MinLatency == 0 || rec.Latency < result.MinLatency {
+			result.MinLatency = rec.Latency
+		}
+		result.TotalCost += rec.Cost
+		if result.MaxCost == 0 || rec.Cost > result.MaxCost {
+			result.MaxCost = rec.Cost
+		}
+		if result.MinCost == 0 || rec.Cost < result.MinCost {
+			result.MinCost = rec.Cost
+		}
+		if result.Records >= max {
+			break
 		}
 	}
+	sort.Sort(latencies)
+	result.P50Latency = latencies.percentile(50)
+	result.P95Latency = latencies.percentile(95)
+	result.P99Latency = latencies.percentile(99)
 	return
 }
 
@@ -172,6 +250,35 @@ func MemcacheDel(c PersistenceContext, model interface{}) (err error) {
 	return memcache.Del(c, keys...)
 }
 
+/*
+DisableMemcacheKind will stop memcache from being used for models of kind, both when found by id and by finders.
+
+Invalidation of the memcache keys will still happen, so EnableMemcacheKind can safely be used to turn memcache back on.
+*/
+func DisableMemcacheKind(kind string) {
+	for _, prefix := range memcachePrefixes(kind) {
+		memcache.DisablePrefix(prefix)
+	}
+}
+
+/*
+EnableMemcacheKind will undo a previous DisableMemcacheKind for kind.
+*/
+func EnableMemcacheKind(kind string) {
+	for _, prefix := range memcachePrefixes(kind) {
+		memcache.EnablePrefix(prefix)
+	}
+}
+
+// memcachePrefixes returns the prefixes of all memcache keys keyById and finders will use for kind.
+func memcachePrefixes(kind string) []string {
+	return []string{
+		fmt.Sprintf("%s{Id:", kind),
+		fmt.Sprintf("get{Typ:%v,", kind),
+		fmt.Sprintf("count{Typ:%v,", kind),
+	}
+}
+
 // keyById will return the memcache key used to find dst by id.
 func keyById(dst interface{}) (result string, err error) {
 	typ, id, err := getTypeAndId(dst)
@@ -220,7 +327,7 @@ type ErrNoSuchEntity struct {
 }
 
 func (self ErrNoSuchEntity) Error() string {
-	return fmt.Sprintf("No %v with id %v found", self.Type, self.Id)
+	return fmt.Sprintf("No %v with id %v found", self.Type, self.Id.Path())
 }
 
 func (self ErrNoSuchEntity) Respond(c httpcontext.HTTPContext) (err error) {
@@ -273,6 +380,9 @@ func Del(c PersistenceContext, src interface{}) (err error) {
 			if err = runProcess(c, old.Interface(), BeforeDeleteName, nil); err != nil {
 				return
 			}
+			if err = trackEntityGroups(c, id); err != nil {
+				return
+			}
 			if err = datastore.Delete(c, gaeKey); err != nil {
 				return
 			}
@@ -389,14 +499,17 @@ func PutMulti(c PersistenceContext, src interface{}) (err error) {
 		}
 	}
 	// actually save
+	if err = trackEntityGroups(c, ids...); err != nil {
+		return
+	}
 	if gaeKeys, err = datastore.PutMulti(c, gaeKeys, src); err != nil {
 		return
 	}
 	// set ids and add memcache keys from the new entities
+	if ids, err = gaekey.FromGAEMulti(gaeKeys); err != nil {
+		return
+	}
 	for i := 0; i < srcVal.Len(); i++ {
-		if ids[i], err = gaekey.FromGAE(gaeKeys[i]); err != nil {
-			return
-		}
 		srcVal.Index(i).Elem().FieldByName(idFieldName).Set(reflect.ValueOf(ids[i]))
 		if _, err = MemcacheKeys(c, srcVal.Index(i).Interface(), &memcacheKeys); err != nil {
 			return
@@ -430,6 +543,38 @@ This requires the loading of any old versions currently in the datastore, which
 cause some extra work.
 */
 func Put(c PersistenceContext, src interface{}) (err error) {
+	return put(c, src, true)
+}
+
+/*
+PutNoOldLoad will save src in datastore like Put, but without first loading any old version of it, which saves a
+datastore read (or memcache lookup) per write.
+
+The price is that only cache keys derived from the new version of src are invalidated. Cached finder results keyed on
+the old values of fields that changed (e.g. an AncestorFinder on an indexed field that now has a different value) will
+keep returning src until they expire, so only use it on write heavy paths where the fields used by finders don't change.
+
+Since it can't know if src is created or updated, models with an incomplete key run the create hooks like Put, but
+models with a complete key only run BeforeSave and AfterSave (with a nil old version), and an error is returned if they
+have BeforeCreate, BeforeUpdate, AfterCreate or AfterUpdate hooks.
+
+Note that the BeforeCreate, BeforeUpdate, AfterCreate and AfterUpdate methods of c are skipped as well for models with a
+complete key, without any error, since every PersistenceContext has them and there is no telling if they do anything.
+Don't use PutNoOldLoad with contexts that rely on them.
+*/
+func PutNoOldLoad(c PersistenceContext, src interface{}) (err error) {
+	return put(c, src, false)
+}
+
+var createAndUpdateHooks = []string{
+	BeforeCreateName,
+	BeforeUpdateName,
+	AfterCreateName,
+	AfterUpdateName,
+}
+
+// put implements Put and PutNoOldLoad.
+func put(c PersistenceContext, src interface{}, loadOld bool) (err error) {
 	var id key.Key
 	if _, id, err = getTypeAndId(src); err != nil {
 		return
@@ -441,7 +586,20 @@ func Put(c PersistenceContext, src interface{}) (err error) {
 	gaeKey := gaekey.ToGAE(c, id)
 	memcacheKeys := []string{}
 	var oldIf interface{}
-	if !gaeKey.Incomplete() {
+	// unknownOld is true if we don't know if there is an old version, and can't run create and update hooks, neither the
+	// ones of src (which we refuse) nor the ones of c (which we skip)
+	unknownOld := !loadOld && !gaeKey.Incomplete()
+	if unknownOld {
+		for _, name := range createAndUpdateHooks {
+			var found bool
+			if _, found, err = getProcess(src, name, nil); err != nil {
+				return
+			} else if found {
+				err = utils.Errorf("%+v has a %v hook and can't be saved without loading its old version", src, name)
+				return
+			}
+		}
+	} else if !gaeKey.Incomplete() {
 		old := reflect.New(reflect.TypeOf(src).Elem())
 		old.Elem().FieldByName(idFieldName).Set(reflect.ValueOf(id))
 		err = GetById(c, old.Interface())
@@ -456,18 +614,23 @@ func Put(c PersistenceContext, src interface{}) (err error) {
 			return
 		}
 	}
-	if oldIf == nil {
-		if err = runProcess(c, src, BeforeCreateName, nil); err != nil {
-			return
-		}
-	} else {
-		if err = runProcess(c, src, BeforeUpdateName, oldIf); err != nil {
-			return
+	if !unknownOld {
+		if oldIf == nil {
+			if err = runProcess(c, src, BeforeCreateName, nil); err != nil {
+				return
+			}
+		} else {
+			if err = runProcess(c, src, BeforeUpdateName, oldIf); err != nil {
+				return
+			}
 		}
 	}
 	if err = runProcess(c, src, BeforeSaveName, oldIf); err != nil {
 		return
 	}
+	if err = trackEntityGroups(c, id); err != nil {
+		return
+	}
 	if id, err = gaekey.FromGAErr(datastore.Put(c, gaeKey, src)); err != nil {
 		return
 	}
@@ -478,13 +641,15 @@ func Put(c PersistenceContext, src interface{}) (err error) {
 	if err = memcache.Del(c, memcacheKeys...); err != nil {
 		return
 	}
-	if oldIf == nil {
-		if err = runProcess(c, src, AfterCreateName, nil); err != nil {
-			return
-		}
-	} else {
-		if err = runProcess(c, src, AfterUpdateName, oldIf); err != nil {
-			return
+	if !unknownOld {
+		if oldIf == nil {
+			if err = runProcess(c, src, AfterCreateName, nil); err != nil {
+				return
+			}
+		} else {
+			if err = runProcess(c, src, AfterUpdateName, oldIf); err != nil {
+				return
+			}
 		}
 	}
 	return runProcess(c, src, AfterSaveName, oldIf)
@@ -550,6 +715,67 @@ func GetById(c PersistenceContext, dst interface{}) (err error) {
 	return
 }
 
+/*
+ConsistencyReport describes how a model cached by GetById compares to the same model in the datastore.
+*/
+type ConsistencyReport struct {
+	Key         key.Key
+	InDatastore bool
+	InMemcache  bool
+	// CachedMiss is true if memcache claims the model doesn't exist.
+	CachedMiss bool
+	// Diff contains the fields that differ, with the cached values as Old and the datastore values as New.
+	Diff map[string]utils.Change
+}
+
+/*
+Consistent returns whether memcache agrees with the datastore, which includes the model not being cached at all.
+*/
+func (self ConsistencyReport) Consistent() bool {
+	if !self.InMemcache {
+		return true
+	}
+	if self.CachedMiss {
+		return !self.InDatastore
+	}
+	return self.InDatastore && len(self.Diff) == 0
+}
+
+/*
+CheckConsistency will load dst, which must have its Id set, directly from the datastore, and compare it to what GetById
+has cached for it in memcache, without running AfterLoad functions or populating the cache.
+
+It is meant for diagnosing stale cache entries, e.g. from an admin endpoint.
+*/
+func CheckConsistency(c PersistenceContext, dst interface{}) (report *ConsistencyReport, err error) {
+	k, err := keyById(dst)
+	if err != nil {
+		return
+	}
+	report = &ConsistencyReport{}
+	if _, report.Key, err = getTypeAndId(dst); err != nil {
+		return
+	}
+	clear(c, reflect.ValueOf(dst).Elem())
+	if err = findById(c, dst); err == nil {
+		report.InDatastore = true
+	} else if _, ok := err.(ErrNoSuchEntity); ok {
+		err = nil
+	} else {
+		return
+	}
+	cached := reflect.New(reflect.TypeOf(dst).Elem())
+	if report.InMemcache, report.CachedMiss, err = memcache.Peek(c, k, cached.Interface()); err != nil {
+		return
+	}
+	if report.InMemcache && !report.CachedMiss && report.InDatastore {
+		if report.Diff, err = utils.Diff(cached.Interface(), dst); err != nil {
+			return
+		}
+	}
+	return
+}
+
 func DelAll(c PersistenceContext, src interface{}) (err error) {
 	srcTyp := reflect.TypeOf(src)
 	if srcTyp.Kind() != reflect.Ptr {
@@ -564,11 +790,7 @@ func DelAll(c PersistenceContext, src interface{}) (err error) {
 }
 
 func GetMulti(c PersistenceContext, ids []key.Key, src interface{}) (err error) {
-	dsIds := make([]*datastore.Key, len(ids))
-	for index, id := range ids {
-		dsIds[index] = gaekey.ToGAE(c, id)
-	}
-	getErr := datastore.GetMulti(c, dsIds, src)
+	getErr := datastore.GetMulti(c, gaekey.ToGAEMulti(c, ids), src)
 	merr, isMerr := getErr.(appengine.MultiError)
 	if !isMerr && getErr != nil {
 		err = getErr
@@ -621,13 +843,13 @@ func GetQuery(c PersistenceContext, src interface{}, q *datastore.Query) (err er
 	if err = FilterOkErrors(err); err != nil {
 		return
 	}
+	var ks []key.Key
+	if ks, err = gaekey.FromGAEMulti(dataIds); err != nil {
+		return
+	}
 	srcVal := reflect.ValueOf(src)
-	for index, dataId := range dataIds {
+	for index, k := range ks {
 		el := srcVal.Elem().Index(index)
-		var k key.Key
-		if k, err = gaekey.FromGAE(dataId); err != nil {
-			return
-		}
 		if el.Kind() == reflect.Ptr {
 			el.Elem().FieldByName("Id").Set(reflect.ValueOf(k))
 			if err = runProcess(c, el.Interface(), AfterLoadName, nil); err != nil {
@@ -652,15 +874,15 @@ func DelQuery(c PersistenceContext, src interface{}, q *datastore.Query) (err er
 	if err = FilterOkErrors(err); err != nil {
 		return
 	}
+	var ks []key.Key
+	if ks, err = gaekey.FromGAEMulti(dataIds); err != nil {
+		return
+	}
 	memcacheKeys := []string{}
 	var el reflect.Value
 	resultsSlice := results.Elem()
-	for index, dataId := range dataIds {
+	for index, k := range ks {
 		el = resultsSlice.Index(index)
-		var k key.Key
-		if k, err = gaekey.FromGAE(dataId); err != nil {
-			return
-		}
 		el.FieldByName("Id").Set(reflect.ValueOf(k))
 		if _, err = MemcacheKeys(c, el.Addr().Interface(), &memcacheKeys); err != nil {
 			return
@@ -7,11 +7,15 @@ import (
 	"math/rand"
 	"net/http"
 	"reflect"
+	"runtime"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/zond/sybutils/utils"
 	"github.com/zond/sybutils/utils/gae"
+	"github.com/zond/sybutils/utils/gae/memcache"
 	"github.com/zond/sybutils/utils/key"
 	"github.com/zond/sybutils/utils/web/httpcontext"
 	"github.com/zond/sybutils/utils/web/jsoncontext"
@@ -34,15 +38,61 @@ type ServiceStatus struct {
 	Status4xx string        `json:"status_4xx"`
 	LogStats  *gae.LogStats `json:"log_stats"`
 	Desc      string        `json:"desc"`
+	// P50, P95 and P99 are the latency percentiles of the sampled requests, in milliseconds.
+	P50 int64 `json:"p50"`
+	P95 int64 `json:"p95"`
+	P99 int64 `json:"p99"`
 }
 
+/*
+ServiceStatusConfig configures a ConfiguredServiceStatusRenderer.
+*/
+type ServiceStatusConfig struct {
+	// Ok4xxRatio and Ok5xxRatio are the highest ratios of 4xx and 5xx responses considered ok.
+	Ok4xxRatio float64
+	Ok5xxRatio float64
+	// Window is how far back in the logs to look, DefaultServiceStatusWindow if zero.
+	Window time.Duration
+	// Samples is the max number of log records to look at, DefaultServiceStatusSamples if zero.
+	Samples int
+	// MinRecords is the number of log records required for the status to be ok.
+	MinRecords int
+}
+
+const (
+	DefaultServiceStatusWindow  = time.Hour
+	DefaultServiceStatusSamples = 128
+)
+
 func ServiceStatusRenderer(ok4xxRatio, ok5xxRatio float64) func(c JSONContext) (status int, result *ServiceStatus, err error) {
+	return ConfiguredServiceStatusRenderer(ServiceStatusConfig{
+		Ok4xxRatio: ok4xxRatio,
+		Ok5xxRatio: ok5xxRatio,
+	})
+}
+
+/*
+ConfiguredServiceStatusRenderer returns a renderer of the status of the service, based on the latest log records
+as configured by config.
+
+If there are fewer than config.MinRecords records, the status will be status_insufficient_records.
+*/
+func ConfiguredServiceStatusRenderer(config ServiceStatusConfig) func(c JSONContext) (status int, result *ServiceStatus, err error) {
+	if config.Window == 0 {
+		config.Window = DefaultServiceStatusWindow
+	}
+	if config.Samples == 0 {
+		config.Samples = DefaultServiceStatusSamples
+	}
 	return func(c JSONContext) (status int, result *ServiceStatus, err error) {
 		result = &ServiceStatus{
 			Desc: "It's Log, Log, it's better than bad, it's good!",
 		}
-		stats := gae.GetLogStats(c, time.Now().Add(-time.Hour), time.Now(), 128, false)
+		stats := gae.GetLogStats(c, time.Now().Add(-config.Window), time.Now(), config.Samples, false)
 		result.Status = "status_ok"
+		if stats.Records < config.MinRecords {
+			result.Status = "status_insufficient_records"
+		}
 		var num4xx float64
 		var num5xx float64
 		var ratio4xx float64
@@ -59,17 +109,20 @@ func ServiceStatusRenderer(ok4xxRatio, ok5xxRatio float64) func(c JSONContext) (
 			ratio4xx = num4xx / float64(stats.Records)
 			ratio5xx = num5xx / float64(stats.Records)
 		}
-		if ratio4xx < ok4xxRatio {
+		if ratio4xx < config.Ok4xxRatio {
 			result.Status4xx = "status_4xx_ok"
 		} else {
 			result.Status4xx = "status_4xx_bad"
 		}
-		if ratio5xx < ok5xxRatio {
+		if ratio5xx < config.Ok5xxRatio {
 			result.Status5xx = "status_5xx_ok"
 		} else {
 			result.Status5xx = "status_5xx_bad"
 		}
 		result.LogStats = stats
+		result.P50 = int64(stats.P50Latency / time.Millisecond)
+		result.P95 = int64(stats.P95Latency / time.Millisecond)
+		result.P99 = int64(stats.P99Latency / time.Millisecond)
 		return
 	}
 }
@@ -118,11 +171,80 @@ func CallTransactionFunction(c GAEContext, f interface{}) (err error) {
 	return nil
 }
 
+/*
+EntityGroupTracking is the default, for contexts created by NewContext, of whether transactions record the entity groups
+written to, and fail before datastore does if there are too many of them. Use SetEntityGroupTracking to change it
+for a single context.
+*/
+var EntityGroupTracking = false
+
+/*
+MaxCrossGroupEntityGroups is the number of entity groups a cross group transaction is allowed to write to when
+entity group tracking is enabled.
+*/
+var MaxCrossGroupEntityGroups = 5
+
+/*
+HoldAfterTransaction makes transactions keep the AfterTransaction funcs registered in them on the context that ran the
+transaction, instead of running them after committing, until RunAfterTransaction is called.
+
+It is meant for tests that want to inspect and run the funcs deterministically.
+*/
+var HoldAfterTransaction = false
+
+type afterTransactionFunc struct {
+	name string
+	f    func(GAEContext) error
+}
+
+/*
+afterTransactionFuncs is shared by all copies of a DefaultContext, e.g. those made by WithValue, so that funcs registered
+in any of them are run.
+*/
+type afterTransactionFuncs struct {
+	lock  sync.Mutex
+	funcs []afterTransactionFunc
+}
+
+func (self *afterTransactionFuncs) add(funcs ...afterTransactionFunc) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.funcs = append(self.funcs, funcs...)
+}
+
+func (self *afterTransactionFuncs) take() (result []afterTransactionFunc) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result, self.funcs = self.funcs, nil
+	return
+}
+
+func (self *afterTransactionFuncs) names() (result []string) {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for _, afterFunc := range self.funcs {
+		result = append(result, afterFunc.name)
+	}
+	return
+}
+
 type DefaultContext struct {
 	context.Context
+	baseContext                 context.Context
 	allowHTTPDuringTransactions bool
 	inTransaction               bool
-	afterTransaction            []func(GAEContext) error
+	crossGroup                  bool
+	entityGroupTracking         bool
+	entityGroups                map[string]string
+	afterTransaction            *afterTransactionFuncs
+	heldAfterTransaction        *afterTransactionFuncs
+	pendingDels                 *memcache.PendingDels
 	clientTimeout               time.Duration
 }
 
@@ -167,7 +289,10 @@ func (self *DefaultContext) AfterTransaction(f interface{}) (err error) {
 		return
 	}
 	if self.inTransaction {
-		self.afterTransaction = append(self.afterTransaction, afterFunc)
+		self.afterTransaction.add(afterTransactionFunc{
+			name: runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name(),
+			f:    afterFunc,
+		})
 	} else {
 		if err = afterFunc(self); err != nil {
 			return
@@ -176,6 +301,81 @@ func (self *DefaultContext) AfterTransaction(f interface{}) (err error) {
 	return
 }
 
+/*
+DelLater implements memcache.DelLaterContext.
+
+Inside BufferDels the keys are deleted when f returns, inside transactions they are deleted after the transaction
+(joining any surrounding BufferDels), and otherwise they are deleted immediately.
+*/
+func (self *DefaultContext) DelLater(keys ...string) (err error) {
+	if self.pendingDels == nil {
+		if !self.inTransaction {
+			return memcache.Del(self, keys...)
+		}
+		pending := &memcache.PendingDels{}
+		if err = self.AfterTransaction(func(c GAEContext) error {
+			return memcache.DelLater(c, pending.Take()...)
+		}); err != nil {
+			return
+		}
+		self.pendingDels = pending
+	}
+	self.pendingDels.Add(keys...)
+	return
+}
+
+/*
+BufferDels runs f, and makes the keys given to DelLater during it deleted once, when f returns.
+*/
+func (self *DefaultContext) BufferDels(f func() error) (err error) {
+	if self.pendingDels != nil {
+		return f()
+	}
+	self.pendingDels = &memcache.PendingDels{}
+	defer func() {
+		pending := self.pendingDels
+		self.pendingDels = nil
+		if flushErr := pending.Flush(self); err == nil {
+			err = flushErr
+		}
+	}()
+	return f()
+}
+
+/*
+PendingAfterTransaction returns the names of the AfterTransaction funcs registered in the current transaction, followed by
+those held from finished transactions because of HoldAfterTransaction.
+*/
+func (self *DefaultContext) PendingAfterTransaction() (result []string) {
+	return append(self.afterTransaction.names(), self.heldAfterTransaction.names()...)
+}
+
+/*
+RunAfterTransaction runs and forgets the AfterTransaction funcs held from finished transactions because of
+HoldAfterTransaction, like they would have been run after the transactions committed.
+*/
+func (self *DefaultContext) RunAfterTransaction() (err error) {
+	if self.inTransaction {
+		err = fmt.Errorf("Can't run AfterTransaction funcs inside a transaction")
+		return
+	}
+	return self.runAfterTransaction(self.heldAfterTransaction.take())
+}
+
+// runAfterTransaction runs all funcs with self, and returns their errors as an appengine.MultiError.
+func (self *DefaultContext) runAfterTransaction(funcs []afterTransactionFunc) (err error) {
+	var multiErr appengine.MultiError
+	for _, afterFunc := range funcs {
+		if err := afterFunc.f(self); err != nil {
+			multiErr = append(multiErr, err)
+		}
+	}
+	if len(multiErr) > 0 {
+		err = multiErr
+	}
+	return
+}
+
 /*
 Implement all the hook functions required by Context
 */
@@ -196,13 +396,14 @@ func (self *DefaultContext) Debugf(format string, i ...interface{}) {
 }
 
 /*
-split will Sprintf(format, i...) and return chunks no longer than 8k of the resulting string.
+split will Sprintf(format, i...) and return chunks no longer than 8k of the resulting string, without splitting any runes.
 */
 func (self *DefaultContext) split(format string, i ...interface{}) (result []string) {
 	msg := fmt.Sprintf(format, i...)
 	for len(msg) > 8000 {
-		result = append(result, msg[:8000])
-		msg = msg[8000:]
+		chunk := utils.TruncateUTF8(msg, 8000)
+		result = append(result, chunk)
+		msg = msg[len(chunk):]
 	}
 	result = append(result, msg)
 	return
@@ -289,92 +490,284 @@ func (self *DefaultContext) InTransaction() bool {
 	return self.inTransaction
 }
 
+/*
+SetEntityGroupTracking sets whether transactions started by self will track their entity groups, see EntityGroupTracking.
+*/
+func (self *DefaultContext) SetEntityGroupTracking(b bool) {
+	self.entityGroupTracking = b
+}
+
+/*
+TrackEntityGroups implements gae.EntityGroupTracker.
+
+It will record the entity groups of ids if entity group tracking was enabled when the transaction started,
+and return an error naming the kinds of the entity groups if there are more than the transaction allows.
+*/
+func (self *DefaultContext) TrackEntityGroups(ids ...key.Key) (err error) {
+	if self.entityGroups == nil {
+		return
+	}
+	for _, id := range ids {
+		root := id
+		for root.Parent() != "" {
+			root = root.Parent()
+		}
+		groupKey := string(root)
+		if root.StringID() == "" && root.IntID() == 0 {
+			// incomplete root keys will all become new entity groups
+			groupKey = fmt.Sprintf("%v#%v", root, len(self.entityGroups))
+		}
+		self.entityGroups[groupKey] = root.Kind()
+	}
+	max := 1
+	if self.crossGroup {
+		max = MaxCrossGroupEntityGroups
+	}
+	if len(self.entityGroups) > max {
+		kinds := map[string]int{}
+		for _, kind := range self.entityGroups {
+			kinds[kind]++
+		}
+		err = utils.Errorf("too many entity groups (%v), max %v: %v", len(self.entityGroups), max, kinds)
+	}
+	return
+}
+
+/*
+WithValue implements gae.ValueContext, returning a copy of self whose Value method returns val for key.
+*/
+func (self *DefaultContext) WithValue(key, val interface{}) gae.PersistenceContext {
+	newContext := *self
+	newContext.Context = context.WithValue(self.Context, key, val)
+	if self.baseContext != nil {
+		newContext.baseContext = context.WithValue(self.baseContext, key, val)
+	}
+	return &newContext
+}
+
+/*
+NonTransactional will run f with a copy of self that isn't in a transaction, using the context self was created with.
+
+Datastore operations made by f will not join any transaction self is in, so they won't add to its entity group footprint.
+They will however not be consistent with the transaction, nor be retried or rolled back with it, and anything f writes
+will be visible to others even if the transaction later fails.
+*/
+func (self *DefaultContext) NonTransactional(f func(c GAEContext) error) error {
+	newContext := *self
+	newContext.inTransaction = false
+	newContext.entityGroups = nil
+	newContext.afterTransaction = nil
+	newContext.pendingDels = nil
+	if self.baseContext != nil {
+		newContext.Context = self.baseContext
+	}
+	return f(&newContext)
+}
+
+/*
+TransactionRetryPolicy configures how transactions failing due to concurrent transactions are retried.
+*/
+type TransactionRetryPolicy struct {
+	// Timeout is how long to keep retrying before giving up.
+	Timeout time.Duration
+	// MaxAttempts is how many times to try at most, zero meaning no limit other than Timeout.
+	MaxAttempts int
+	// Backoff and MaxBackoff are the base and max of the jittered exponential backoff between retries, see utils.Backoff.
+	// A zero Backoff sleeps a random duration of up to 500ms times the number of attempts so far instead.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+/*
+sleep returns how long to sleep before retrying after attempt (starting at 0) failed.
+*/
+func (self TransactionRetryPolicy) sleep(attempt int) time.Duration {
+	if self.Backoff == 0 {
+		return time.Millisecond * time.Duration(rand.Int63()%int64(500*(attempt+1)))
+	}
+	return utils.Backoff(self.Backoff, self.MaxBackoff, attempt)
+}
+
+/*
+DefaultTransactionRetryPolicy is the TransactionRetryPolicy used by Transaction, retrying for up to 20 seconds.
+*/
+var DefaultTransactionRetryPolicy = TransactionRetryPolicy{
+	Timeout: time.Second * 20,
+}
+
+/*
+RetryPolicyTransactioner is a GAEContext that can run transactions with a custom TransactionRetryPolicy.
+*/
+type RetryPolicyTransactioner interface {
+	TransactionWithRetryPolicy(f interface{}, crossGroup bool, policy TransactionRetryPolicy) error
+}
+
+/*
+TransactionWithRetryPolicy will run f in a transaction if c is a RetryPolicyTransactioner, otherwise it will use
+c.Transaction and its default retries.
+*/
+func TransactionWithRetryPolicy(c GAEContext, f interface{}, crossGroup bool, policy TransactionRetryPolicy) error {
+	if transactioner, ok := c.(RetryPolicyTransactioner); ok {
+		return transactioner.TransactionWithRetryPolicy(f, crossGroup, policy)
+	}
+	return c.Transaction(f, crossGroup)
+}
+
+/*
+IsConcurrentTransactionError returns whether err, or any error wrapped by it, was caused by concurrent transactions.
+*/
+func IsConcurrentTransactionError(err error) (hasConcErr bool) {
+	if err == nil {
+		return false
+	}
+	if dserr, ok := err.(utils.DefaultStackError); ok {
+		// our own stack errors, based on a concurrent transaction error
+		if dserr.Source == datastore.ErrConcurrentTransaction {
+			hasConcErr = true
+		} else {
+			// if they are based on appengine or utils multierrors, check for concurrency errors inside
+			if merr, ok := dserr.Source.(appengine.MultiError); ok {
+				for _, e := range merr {
+					if e == datastore.ErrConcurrentTransaction {
+						hasConcErr = true
+						break
+					}
+				}
+			} else if merr, ok := dserr.Source.(utils.MultiError); ok {
+				for _, e := range merr {
+					if e == datastore.ErrConcurrentTransaction {
+						hasConcErr = true
+						break
+					}
+				}
+			}
+		}
+	} else if err == datastore.ErrConcurrentTransaction {
+		// or if they ARE concurrency errors!
+		hasConcErr = true
+	}
+	if !hasConcErr && strings.Contains(strings.ToLower(err.Error()), "concurrent") {
+		// or, if they are the special black ops concurrency errors that google never talk openly about
+		hasConcErr = true
+	}
+	if !hasConcErr && strings.Contains(strings.ToLower(err.Error()), "transaction closed") {
+		// or, they are the even more magical "transaction closed" errors that don't even know about the cause why it was closed
+		hasConcErr = true
+	}
+	return
+}
+
 /*
 Transaction will run f inside a transaction, optionally crossGroup (more than 1 but LESS THAN FIVE entity groups involved).
 
-If it fails due to other concurrent transactions, it will retry this transaction up until 20 seconds have passed.
+If it fails due to other concurrent transactions, it will retry it according to DefaultTransactionRetryPolicy.
 */
 func (self *DefaultContext) Transaction(f interface{}, crossGroup bool) (err error) {
+	return self.TransactionWithRetryPolicy(f, crossGroup, DefaultTransactionRetryPolicy)
+}
+
+/*
+TransactionWithRetryPolicy will run f in a transaction, retrying it according to policy if it fails due to concurrent
+transactions.
+*/
+func (self *DefaultContext) TransactionWithRetryPolicy(f interface{}, crossGroup bool, policy TransactionRetryPolicy) (err error) {
 	if self.inTransaction {
 		return CallTransactionFunction(self, f)
 	}
 	var newContext DefaultContext
-	/*
-	 * Instead of retrying 3 times, something that we see fail multible times, try
-	 * get transaction working waiting for max 20 seconds.
-	 */
 	start := time.Now()
-	tries := 0
-	for time.Since(start) < (time.Second * 20) {
-		hasConcErr := false
+	for attempt := 0; ; attempt++ {
 		err = datastore.RunInTransaction(self, func(c context.Context) error {
 			newContext = *self
+			if newContext.baseContext == nil {
+				newContext.baseContext = self.Context
+			}
 			newContext.Context = c
 			newContext.inTransaction = true
+			newContext.crossGroup = crossGroup
+			newContext.afterTransaction = &afterTransactionFuncs{}
+			newContext.pendingDels = nil
+			newContext.entityGroups = nil
+			if newContext.entityGroupTracking {
+				newContext.entityGroups = map[string]string{}
+			}
 			return CallTransactionFunction(&newContext, f)
 		}, &datastore.TransactionOptions{XG: crossGroup})
 		if err == nil {
 			break
 		}
-		/* Dont fail on concurrent transaction.. Continue trying... */
-		if dserr, ok := err.(utils.DefaultStackError); ok {
-			// our own stack errors, based on a concurrent transaction error
-			if dserr.Source == datastore.ErrConcurrentTransaction {
-				hasConcErr = true
-			} else {
-				// if they are based on appengine or utils multierrors, check for concurrency errors inside
-				if merr, ok := dserr.Source.(appengine.MultiError); ok {
-					for _, e := range merr {
-						if e == datastore.ErrConcurrentTransaction {
-							hasConcErr = true
-							break
-						}
-					}
-				} else if merr, ok := dserr.Source.(utils.MultiError); ok {
-					for _, e := range merr {
-						if e == datastore.ErrConcurrentTransaction {
-							hasConcErr = true
-							break
-						}
-					}
-				}
-			}
-		} else if err == datastore.ErrConcurrentTransaction {
-			// or if they ARE concurrency errors!
-			hasConcErr = true
-		}
-		if !hasConcErr && strings.Contains(strings.ToLower(err.Error()), "concurrent") {
-			// or, if they are the special black ops concurrency errors that google never talk openly about
-			hasConcErr = true
-		}
-		if !hasConcErr && strings.Contains(strings.ToLower(err.Error()), "transaction closed") {
-			// or, they are the even more magical "transaction closed" errors that don't even know about the cause why it was closed
-			hasConcErr = true
+		/* Dont fail on concurrent transaction.. Continue trying, but back off and give up eventually. */
+		if !IsConcurrentTransactionError(err) {
+			break
 		}
-		if hasConcErr {
-			lines := strings.Split(utils.Stack(), "\n")
-			self.Debugf("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!! DANGER ! Failed to run %v in transaction due to %v, retrying... !!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!", lines[9:11], err)
-			tries += 1
-			time.Sleep(time.Millisecond * time.Duration(rand.Int63()%int64(500*tries)))
-		} else {
+		if (policy.MaxAttempts > 0 && attempt+1 >= policy.MaxAttempts) || time.Since(start) > policy.Timeout {
+			self.Debugf("Giving up running transaction after %v attempts during %v: %v", attempt+1, time.Since(start), err)
 			break
 		}
+		lines := strings.Split(utils.Stack(), "\n")
+		self.Debugf("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!! DANGER ! Failed to run %v in transaction due to %v, retrying... !!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!", lines[9:11], err)
+		time.Sleep(policy.sleep(attempt))
 	}
 	if err != nil {
 		return
 	}
 
-	// After transaction sucessfull, run all the AfterTransaction registered callbacks.
-	var multiErr appengine.MultiError
-	for _, cb := range newContext.afterTransaction {
-		if err := cb(self); err != nil {
-			multiErr = append(multiErr, err)
+	// After transaction sucessfull, run (or hold) all the AfterTransaction registered callbacks.
+	funcs := newContext.afterTransaction.take()
+	if HoldAfterTransaction {
+		if self.heldAfterTransaction == nil {
+			self.heldAfterTransaction = &afterTransactionFuncs{}
 		}
+		self.heldAfterTransaction.add(funcs...)
+		return
 	}
-	if len(multiErr) > 0 {
-		err = multiErr
+	return self.runAfterTransaction(funcs)
+}
+
+// bufferDels calls BufferDels on c if it has one, and otherwise just runs f.
+func bufferDels(c GAEContext, f func() error) error {
+	if buffering, ok := c.(interface {
+		BufferDels(f func() error) error
+	}); ok {
+		return buffering.BufferDels(f)
+	}
+	return f()
+}
+
+// trackEntityGroups calls TrackEntityGroups on c if it is a gae.EntityGroupTracker.
+func trackEntityGroups(c GAEContext, ids ...key.Key) error {
+	if tracker, ok := c.(gae.EntityGroupTracker); ok {
+		return tracker.TrackEntityGroups(ids...)
+	}
+	return nil
+}
+
+// valueContext is a GAEContext whose Value method returns val for key, for GAEContexts that aren't gae.ValueContexts.
+type valueContext struct {
+	GAEContext
+	key interface{}
+	val interface{}
+}
+
+func (self valueContext) Value(key interface{}) interface{} {
+	if key == self.key {
+		return self.val
+	}
+	return self.GAEContext.Value(key)
+}
+
+// withValue returns a copy of c whose Value method returns val for key.
+func withValue(c GAEContext, key, val interface{}) GAEContext {
+	if vc, ok := c.(gae.ValueContext); ok {
+		if result, ok := vc.WithValue(key, val).(GAEContext); ok {
+			return result
+		}
+	}
+	return valueContext{
+		GAEContext: c,
+		key:        key,
+		val:        val,
 	}
-	return
 }
 
 type DefaultHTTPContext struct {
@@ -390,6 +783,35 @@ func (self *DefaultHTTPContext) Transaction(f interface{}, crossGroup bool) erro
 	}, crossGroup)
 }
 
+// DelLater implements memcache.DelLaterContext, see memcache.DelLater.
+func (self *DefaultHTTPContext) DelLater(keys ...string) error {
+	return memcache.DelLater(self.GAEContext, keys...)
+}
+
+// BufferDels runs f, buffering DelLater if the wrapped GAEContext supports it.
+func (self *DefaultHTTPContext) BufferDels(f func() error) error {
+	return bufferDels(self.GAEContext, f)
+}
+
+// TrackEntityGroups implements gae.EntityGroupTracker if the wrapped GAEContext does.
+func (self *DefaultHTTPContext) TrackEntityGroups(ids ...key.Key) error {
+	return trackEntityGroups(self.GAEContext, ids...)
+}
+
+func (self *DefaultHTTPContext) WithValue(key, val interface{}) gae.PersistenceContext {
+	newContext := *self
+	newContext.GAEContext = withValue(self.GAEContext, key, val)
+	return &newContext
+}
+
+func (self *DefaultHTTPContext) TransactionWithRetryPolicy(f interface{}, crossGroup bool, policy TransactionRetryPolicy) error {
+	return TransactionWithRetryPolicy(self.GAEContext, func(c GAEContext) error {
+		newContext := *self
+		newContext.GAEContext = c
+		return CallTransactionFunction(&newContext, f)
+	}, crossGroup, policy)
+}
+
 type DefaultJSONContext struct {
 	GAEContext
 	jsoncontext.JSONContext
@@ -403,9 +825,41 @@ func (self *DefaultJSONContext) Transaction(f interface{}, crossGroup bool) erro
 	}, crossGroup)
 }
 
+// DelLater implements memcache.DelLaterContext, see memcache.DelLater.
+func (self *DefaultJSONContext) DelLater(keys ...string) error {
+	return memcache.DelLater(self.GAEContext, keys...)
+}
+
+// BufferDels runs f, buffering DelLater if the wrapped GAEContext supports it.
+func (self *DefaultJSONContext) BufferDels(f func() error) error {
+	return bufferDels(self.GAEContext, f)
+}
+
+// TrackEntityGroups implements gae.EntityGroupTracker if the wrapped GAEContext does.
+func (self *DefaultJSONContext) TrackEntityGroups(ids ...key.Key) error {
+	return trackEntityGroups(self.GAEContext, ids...)
+}
+
+func (self *DefaultJSONContext) WithValue(key, val interface{}) gae.PersistenceContext {
+	newContext := *self
+	newContext.GAEContext = withValue(self.GAEContext, key, val)
+	return &newContext
+}
+
+func (self *DefaultJSONContext) TransactionWithRetryPolicy(f interface{}, crossGroup bool, policy TransactionRetryPolicy) error {
+	return TransactionWithRetryPolicy(self.GAEContext, func(c GAEContext) error {
+		newContext := *self
+		newContext.GAEContext = c
+		return CallTransactionFunction(&newContext, f)
+	}, crossGroup, policy)
+}
+
 func NewContext(gaeCont context.Context) (result *DefaultContext) {
 	return &DefaultContext{
-		Context: gaeCont,
+		Context:              gaeCont,
+		baseContext:          gaeCont,
+		entityGroupTracking:  EntityGroupTracking,
+		heldAfterTransaction: &afterTransactionFuncs{},
 	}
 }
 
@@ -437,7 +891,9 @@ func HTTPHandlerFunc(f func(c HTTPContext) error, scopes ...string) http.Handler
 		gaeCont := appengine.NewContext(r)
 		c := NewHTTPContext(gaeCont, httpcontext.NewHTTPContext(w, r))
 		httpcontext.Handle(c, func() error {
-			return f(c)
+			return c.BufferDels(func() error {
+				return f(c)
+			})
 		}, scopes...)
 	})
 }
@@ -453,8 +909,12 @@ func JSONHandlerFunc(f func(c JSONContext) (resp jsoncontext.Resp, err error), m
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		gaeCont := appengine.NewContext(r)
 		c := NewJSONContext(gaeCont, jsoncontext.NewJSONContext(httpcontext.NewHTTPContext(w, r)))
-		jsoncontext.Handle(c, func() (jsoncontext.Resp, error) {
-			return f(c)
+		jsoncontext.Handle(c, func() (resp jsoncontext.Resp, err error) {
+			err = c.BufferDels(func() (err error) {
+				resp, err = f(c)
+				return
+			})
+			return
 		}, minAPIVersion, maxAPIVersion, scopes...)
 	})
 }
@@ -470,8 +930,12 @@ func DataHandlerFunc(f func(c HTTPContext) (resp *httpcontext.DataResp, err erro
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		gaeCont := appengine.NewContext(r)
 		c := NewHTTPContext(gaeCont, httpcontext.NewHTTPContext(w, r))
-		httpcontext.DataHandle(c, func() (*httpcontext.DataResp, error) {
-			return f(c)
+		httpcontext.DataHandle(c, func() (resp *httpcontext.DataResp, err error) {
+			err = c.BufferDels(func() (err error) {
+				resp, err = f(c)
+				return
+			})
+			return
 		}, scopes...)
 	})
 }
@@ -488,11 +952,39 @@ func DocHandle(router *mux.Router, f interface{}, path string, method string, mi
 		gaeCont := appengine.NewContext(r)
 		c := NewJSONContext(gaeCont, jsoncontext.NewJSONContext(httpcontext.NewHTTPContext(w, r)))
 		jsoncontext.Handle(c, func() (resp jsoncontext.Resp, err error) {
-			return fu(c)
+			err = c.BufferDels(func() (err error) {
+				resp, err = fu(c)
+				return
+			})
+			return
 		}, minAPIVersion, maxAPIVersion, scopes...)
 	}))
 }
 
+/*
+DataDocHandle registers f for path (with and without any of the jsoncontext.DataFormats suffixes), method and scopes in the provided
+router, rendering its response with jsoncontext.DataHandle and documenting the route once with jsoncontext.DocumentData.
+*/
+func DataDocHandle(router *mux.Router, f func(c JSONContext) (resp *httpcontext.DataResp, err error), path string, method string, scopes ...string) (doc *jsoncontext.DefaultDocumentedRoute) {
+	doc = jsoncontext.DocumentData(path, method, scopes...)
+	jsoncontext.Remember(doc)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gaeCont := appengine.NewContext(r)
+		c := NewJSONContext(gaeCont, jsoncontext.NewJSONContext(httpcontext.NewHTTPContext(w, r)))
+		jsoncontext.DataHandle(c, func() (resp *httpcontext.DataResp, err error) {
+			err = c.BufferDels(func() (err error) {
+				resp, err = f(c)
+				return
+			})
+			return
+		}, scopes...)
+	})
+	for _, dataPath := range jsoncontext.DataPaths(path) {
+		router.Path(dataPath).Methods(doc.Methods...).Handler(handler)
+	}
+	return
+}
+
 /*
 KeyLock is a generic way of locking certain values for entities without needing the entities have that value in their key.
 */
@@ -501,6 +993,17 @@ type KeyLock struct {
 	Id key.Key `datastore:"-"`
 	// Entity is the id of the holder of the lock.
 	Entity key.Key
+	// LockedAt is when the lock was last taken or refreshed.
+	LockedAt time.Time
+	// TTL is how long after LockedAt the lock expires. Zero means the lock never expires.
+	TTL time.Duration
+}
+
+/*
+expired returns whether this KeyLock has a TTL, and hasn't been taken or refreshed within it.
+*/
+func (self *KeyLock) expired() bool {
+	return self.TTL > 0 && self.LockedAt.Add(self.TTL).Before(time.Now())
 }
 
 type ErrLockTaken struct {
@@ -519,6 +1022,8 @@ func (self ErrLockTaken) Error() string {
 
 /*
 LockedBy will return whether this KeyLock is actually locked in the database and who holds it now.
+
+Expired locks are reported as not locked.
 */
 func (self *KeyLock) LockedBy(c GAEContext) (isLocked bool, lockedBy key.Key, err error) {
 	existingLock := &KeyLock{Id: self.Id}
@@ -530,6 +1035,9 @@ func (self *KeyLock) LockedBy(c GAEContext) (isLocked bool, lockedBy key.Key, er
 			return
 		}
 	}
+	if existingLock.expired() {
+		return
+	}
 	isLocked = true
 	lockedBy = existingLock.Entity
 	return
@@ -537,6 +1045,8 @@ func (self *KeyLock) LockedBy(c GAEContext) (isLocked bool, lockedBy key.Key, er
 
 /*
 Lock will try to lock this KeyLock and make its Id (and the value it is based on) unavailable for other locks.
+
+If the existing lock has expired it will be reclaimed. If TTL is set, the new lock will expire TTL from now unless refreshed.
 */
 func (self *KeyLock) Lock(c GAEContext) error {
 	snapshot := *self
@@ -546,7 +1056,7 @@ func (self *KeyLock) Lock(c GAEContext) error {
 		err = gae.GetById(c, existingLock)
 		if _, ok := err.(gae.ErrNoSuchEntity); ok {
 			err = nil
-		} else if err == nil {
+		} else if err == nil && !existingLock.expired() {
 			err = ErrLockTaken{
 				Key:    self.Id,
 				Entity: existingLock.Entity,
@@ -556,6 +1066,32 @@ func (self *KeyLock) Lock(c GAEContext) error {
 		if err != nil {
 			return
 		}
+		self.LockedAt = time.Now()
+		err = gae.Put(c, self)
+		return
+	}, false)
+}
+
+/*
+Refresh will extend the lease of this KeyLock another TTL from now, provided it is still held by self.Entity.
+*/
+func (self *KeyLock) Refresh(c GAEContext) error {
+	snapshot := *self
+	return c.Transaction(func(c GAEContext) (err error) {
+		*self = snapshot
+		existingLock := &KeyLock{Id: self.Id}
+		if err = gae.GetById(c, existingLock); err != nil {
+			return
+		}
+		if existingLock.Entity != self.Entity {
+			err = ErrLockTaken{
+				Key:    self.Id,
+				Entity: existingLock.Entity,
+				Stack:  utils.Stack(),
+			}
+			return
+		}
+		self.LockedAt = time.Now()
 		err = gae.Put(c, self)
 		return
 	}, false)
@@ -581,6 +1117,67 @@ func (self *KeyLock) Unlock(c GAEContext) (err error) {
 	}, false)
 }
 
+// MaxCrossGroupLocks is the largest number of KeyLocks LockAll will take in a single cross group transaction.
+var MaxCrossGroupLocks = 5
+
+type keyLocksById []*KeyLock
+
+func (a keyLocksById) Len() int           { return len(a) }
+func (a keyLocksById) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a keyLocksById) Less(i, j int) bool { return a[i].Id < a[j].Id }
+
+/*
+LockAll will lock all the provided locks in the order of their Ids, so that processes locking overlapping sets of locks don't deadlock.
+
+If there are no more than MaxCrossGroupLocks locks they will be taken in a single cross group transaction, so that either all or none of them are taken.
+Otherwise they will be taken one at a time, and if one of them is already taken the ones locked so far will be unlocked again.
+*/
+func LockAll(c GAEContext, locks []*KeyLock) (err error) {
+	sorted := make(keyLocksById, len(locks))
+	copy(sorted, locks)
+	sort.Sort(sorted)
+	if len(sorted) <= MaxCrossGroupLocks {
+		return c.Transaction(func(c GAEContext) (err error) {
+			for _, lock := range sorted {
+				if err = lock.Lock(c); err != nil {
+					return
+				}
+			}
+			return
+		}, len(sorted) > 1)
+	}
+	for index, lock := range sorted {
+		if err = lock.Lock(c); err != nil {
+			for _, grabbed := range sorted[:index] {
+				if unlockErr := grabbed.Unlock(c); unlockErr != nil {
+					log.Printf("Unable to release %v after failing to lock %v: %v", grabbed.Id, lock.Id, unlockErr)
+				}
+			}
+			return
+		}
+	}
+	return
+}
+
+/*
+UnlockAll will unlock all the provided locks in the reverse order of their Ids, returning any errors as a utils.MultiError.
+*/
+func UnlockAll(c GAEContext, locks []*KeyLock) (err error) {
+	sorted := make(keyLocksById, len(locks))
+	copy(sorted, locks)
+	sort.Sort(sort.Reverse(sorted))
+	merr := utils.MultiError{}
+	for _, lock := range sorted {
+		if e := lock.Unlock(c); e != nil {
+			merr = append(merr, e)
+		}
+	}
+	if len(merr) > 0 {
+		err = merr
+	}
+	return
+}
+
 type Counter struct {
 	Count int64
 }
@@ -589,6 +1186,15 @@ const (
 	GAEContextCounterKind = "GAEContextCounterKind"
 )
 
+var (
+	// SequenceMaxAttempts is how many times AcquireSequence will try a transaction failing due to concurrent transactions.
+	SequenceMaxAttempts = 10
+	// SequenceTimeout is how long AcquireSequence will keep retrying before giving up.
+	SequenceTimeout = time.Second * 30
+	// SequenceBackoff is the base of the jittered exponential backoff between AcquireSequence retries.
+	SequenceBackoff = time.Millisecond * 20
+)
+
 /*
 AcquireSequenceNo will return the next number in the named sequence.
 */
@@ -597,32 +1203,168 @@ func AcquireSequenceNo(c GAEContext, name string) (result int64, err error) {
 	return
 }
 
+/*
+AcquireSequence will reserve size numbers in the named sequence and return the first of them.
+
+Retries due to concurrent transactions back off with jitter, and are limited by SequenceMaxAttempts and SequenceTimeout
+if c is a RetryPolicyTransactioner.
+*/
 func AcquireSequence(c GAEContext, name string, size int) (first int64, err error) {
-	if size <= 0 {
-		err = fmt.Errorf("can't get a sequence of size < 1")
+	firsts, err := AcquireSequences(c, map[string]int{name: size})
+	if err != nil {
+		return
+	}
+	first = firsts[name]
+	return
+}
+
+/*
+AcquireSequences will reserve the requested number of numbers in each named sequence, in a single cross group transaction
+if more than one sequence is requested, so that either all or none of them are reserved. It returns the first reserved
+number of each sequence.
+
+Since each sequence is its own entity group, no more than MaxCrossGroupEntityGroups sequences can be requested at once.
+
+Retries due to concurrent transactions back off with jitter, and are limited by SequenceMaxAttempts and SequenceTimeout
+if c is a RetryPolicyTransactioner.
+*/
+func AcquireSequences(c GAEContext, requests map[string]int) (firsts map[string]int64, err error) {
+	if len(requests) == 0 {
+		err = fmt.Errorf("can't get no sequences")
 		return
 	}
-	first = 0
-	key := datastore.NewKey(c, GAEContextCounterKind, name, 0, nil)
-	for {
-		err = c.Transaction(func(c GAEContext) (err error) {
-			var x Counter
-			if err = datastore.Get(c, key, &x); err != nil && err != datastore.ErrNoSuchEntity {
+	if len(requests) > MaxCrossGroupEntityGroups {
+		err = fmt.Errorf("can't get more than %v sequences at once", MaxCrossGroupEntityGroups)
+		return
+	}
+	names := make([]string, 0, len(requests))
+	for name, size := range requests {
+		if size <= 0 {
+			err = fmt.Errorf("can't get a sequence of size < 1")
+			return
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	keys := make([]*datastore.Key, len(names))
+	for index, name := range names {
+		keys[index] = datastore.NewKey(c, GAEContextCounterKind, name, 0, nil)
+	}
+	err = TransactionWithRetryPolicy(c, func(c GAEContext) (err error) {
+		counters := make([]Counter, len(keys))
+		if err = datastore.GetMulti(c, keys, counters); err != nil {
+			merr, ok := err.(appengine.MultiError)
+			if !ok {
 				return
 			}
-			x.Count += int64(size)
-			if _, err = datastore.Put(c, key, &x); err != nil {
-				return
+			for _, e := range merr {
+				if e != nil && e != datastore.ErrNoSuchEntity {
+					return e
+				}
 			}
-			first = x.Count - int64(size) + 1
+		}
+		for index, name := range names {
+			counters[index].Count += int64(requests[name])
+		}
+		if _, err = datastore.PutMulti(c, keys, counters); err != nil {
 			return
+		}
+		firsts = map[string]int64{}
+		for index, name := range names {
+			firsts[name] = counters[index].Count - int64(requests[name]) + 1
+		}
+		return
+	}, len(keys) > 1, TransactionRetryPolicy{
+		Timeout:     SequenceTimeout,
+		MaxAttempts: SequenceMaxAttempts,
+		Backoff:     SequenceBackoff,
+		MaxBackoff:  time.Second,
+	})
+	return
+}
 
-		}, false)
+const (
+	GAEContextShardedCounterKind = "GAEContextShardedCounterKind"
+)
 
-		/* Dont fail on concurrent transaction.. Continue trying... */
-		if err != datastore.ErrConcurrentTransaction {
-			break
+// ShardedCounterCacheDuration is how long the summed total of a ShardedCounter stays in memcache.
+var ShardedCounterCacheDuration = time.Minute
+
+/*
+ShardedCounter is a counter spread over a number of datastore entities, to avoid the write contention
+of a single entity when it is incremented frequently.
+*/
+type ShardedCounter struct {
+	Name   string
+	Shards int
+}
+
+/*
+NewShardedCounter returns a counter named name, spread over shards entities.
+
+Changing the number of shards for an existing counter to a lower number will make the counts
+in the removed shards disappear from the total.
+*/
+func NewShardedCounter(name string, shards int) *ShardedCounter {
+	if shards < 1 {
+		shards = 1
+	}
+	return &ShardedCounter{
+		Name:   name,
+		Shards: shards,
+	}
+}
+
+func (self *ShardedCounter) shardKey(c GAEContext, shard int) *datastore.Key {
+	return datastore.NewKey(c, GAEContextShardedCounterKind, fmt.Sprintf("%v#%v", self.Name, shard), 0, nil)
+}
+
+func (self *ShardedCounter) cacheKey() string {
+	return fmt.Sprintf("github.com/zond/sybutils/utils/gae/gaecontext.ShardedCounter{Name:%v}", self.Name)
+}
+
+/*
+Increment will add delta to a random shard of the counter, and invalidate the cached total.
+*/
+func (self *ShardedCounter) Increment(c GAEContext, delta int64) (err error) {
+	key := self.shardKey(c, rand.Intn(self.Shards))
+	if err = c.Transaction(func(c GAEContext) (err error) {
+		var x Counter
+		if err = datastore.Get(c, key, &x); err != nil && err != datastore.ErrNoSuchEntity {
+			return
+		}
+		x.Count += delta
+		_, err = datastore.Put(c, key, &x)
+		return
+	}, false); err != nil {
+		return
+	}
+	return memcache.Del(c, self.cacheKey())
+}
+
+/*
+Count will return the sum of all shards of the counter, memoized in memcache for ShardedCounterCacheDuration.
+*/
+func (self *ShardedCounter) Count(c GAEContext) (result int64, err error) {
+	total := &Counter{}
+	if err = memcache.MemoizeDuring(c, self.cacheKey(), ShardedCounterCacheDuration, false, total, func() (res interface{}, err error) {
+		keys := make([]*datastore.Key, self.Shards)
+		for index := range keys {
+			keys[index] = self.shardKey(c, index)
 		}
+		shards := make([]Counter, self.Shards)
+		if err = gae.FilterOkErrors(datastore.GetMulti(c, keys, shards), datastore.ErrNoSuchEntity); err != nil {
+			return
+		}
+		sum := &Counter{}
+		for _, shard := range shards {
+			sum.Count += shard.Count
+		}
+		res = sum
+		return
+	}); err != nil {
+		return
 	}
+	result = total.Count
 	return
 }
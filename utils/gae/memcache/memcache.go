@@ -10,11 +10,15 @@ import (
 	"log"
 	"math/rand"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/zond/sybutils/utils"
 
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/delay"
 	"google.golang.org/appengine/memcache"
 	"google.golang.org/appengine/taskqueue"
@@ -22,6 +26,47 @@ import (
 
 var MemcacheEnabled = true
 
+var disabledPrefixes = map[string]bool{}
+var disabledPrefixesLock sync.RWMutex
+
+/*
+DisablePrefix will stop Get, Put and the Memoize functions from using memcache for keys starting with prefix,
+while leaving other keys cached.
+
+Del will still delete disabled keys, so that stale values aren't served if the prefix is enabled again.
+*/
+func DisablePrefix(prefix string) {
+	disabledPrefixesLock.Lock()
+	defer disabledPrefixesLock.Unlock()
+	disabledPrefixes[prefix] = true
+}
+
+/*
+EnablePrefix will undo a previous DisablePrefix for prefix.
+*/
+func EnablePrefix(prefix string) {
+	disabledPrefixesLock.Lock()
+	defer disabledPrefixesLock.Unlock()
+	delete(disabledPrefixes, prefix)
+}
+
+/*
+Enabled returns whether memcache is enabled for key, that is if MemcacheEnabled is true and key doesn't start with a disabled prefix.
+*/
+func Enabled(key string) bool {
+	if !MemcacheEnabled {
+		return false
+	}
+	disabledPrefixesLock.RLock()
+	defer disabledPrefixesLock.RUnlock()
+	for prefix := range disabledPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
 type TransactionContext interface {
 	context.Context
 	InTransaction() bool
@@ -43,9 +88,41 @@ func delayedDelete(c context.Context, keys []string) (err error) {
 }
 
 /*
-Keyify will create a memcache-safe key from k by hashing and base64-encoding it.
+ReadablePrefixLength is the number of characters of the original key Keyify prepends to the hash, to make the keys
+recognizable when inspecting memcache. 0 disables the prefix.
+
+It is capped at maxReadablePrefixLength to keep the keys below the memcache key length limit.
+*/
+var ReadablePrefixLength = 0
+
+const maxReadablePrefixLength = 200
+
+var unreadableKeyPattern = regexp.MustCompile("[^A-Za-z0-9_.:{},-]")
+
+/*
+Keyify will create a memcache-safe key from k by hashing and base64-encoding it, prefixed with a sanitized
+prefix of k if ReadablePrefixLength is set.
 */
 func Keyify(k string) (result string, err error) {
+	if ReadablePrefixLength > 0 {
+		prefix := k
+		length := ReadablePrefixLength
+		if length > maxReadablePrefixLength {
+			length = maxReadablePrefixLength
+		}
+		if len(prefix) > length {
+			prefix = prefix[:length]
+		}
+		if result, err = keyHash(k); err != nil {
+			return
+		}
+		result = unreadableKeyPattern.ReplaceAllString(prefix, "_") + "|" + result
+		return
+	}
+	return keyHash(k)
+}
+
+func keyHash(k string) (result string, err error) {
 	buf := new(bytes.Buffer)
 	enc := base64.NewEncoder(base64.URLEncoding, buf)
 	h := sha1.New()
@@ -77,6 +154,32 @@ func Incr(c TransactionContext, key string, delta int64, initial uint64) (newVal
 	return
 }
 
+/*
+IncrMulti will Incr all keys in deltas by their deltas concurrently, returning the new values of the keys.
+
+The appengine memcache API has no batch increment, so this issues one Increment per key, but in parallel.
+*/
+func IncrMulti(c TransactionContext, deltas map[string]int64, initial uint64) (result map[string]uint64, err error) {
+	result = map[string]uint64{}
+	lock := &sync.Mutex{}
+	parallelizer := &utils.Parallelizer{}
+	for key, delta := range deltas {
+		key, delta := key, delta
+		parallelizer.Start(func() (err error) {
+			newValue, err := Incr(c, key, delta, initial)
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			result[key] = newValue
+			return
+		})
+	}
+	err = parallelizer.Wait()
+	return
+}
+
 func IncrExisting(c TransactionContext, key string, delta int64) (newValue uint64, err error) {
 	k, err := Keyify(key)
 	if err != nil {
@@ -107,6 +210,89 @@ func Del(c TransactionContext, keys ...string) (err error) {
 	return delWithRetry(c, keys...)
 }
 
+/*
+DelLaterContext is a TransactionContext that can accumulate keys to delete from memcache and delete them all at once later,
+e.g. at the end of the request.
+*/
+type DelLaterContext interface {
+	TransactionContext
+	DelLater(keys ...string) error
+}
+
+/*
+DelLater will let c accumulate the keys to delete them later, if c is a DelLaterContext, and otherwise delete them using Del.
+
+Only use it when reading the deleted keys before they are actually deleted is acceptable, since that will return the
+cached values.
+*/
+func DelLater(c TransactionContext, keys ...string) (err error) {
+	if delLaterContext, ok := c.(DelLaterContext); ok {
+		return delLaterContext.DelLater(keys...)
+	}
+	return Del(c, keys...)
+}
+
+/*
+PendingDels accumulates unique keys to delete from memcache, for implementing DelLaterContext.
+*/
+type PendingDels struct {
+	lock sync.Mutex
+	keys []string
+	seen map[string]bool
+}
+
+/*
+Add will add the keys not already added.
+*/
+func (self *PendingDels) Add(keys ...string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.seen == nil {
+		self.seen = map[string]bool{}
+	}
+	for _, key := range keys {
+		if !self.seen[key] {
+			self.seen[key] = true
+			self.keys = append(self.keys, key)
+		}
+	}
+}
+
+/*
+Take will return the added keys, in the order they were first added, and forget them.
+*/
+func (self *PendingDels) Take() (result []string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	result, self.keys, self.seen = self.keys, nil, nil
+	return
+}
+
+/*
+Flush will delete the added keys using Del, which means that if c is InTransaction the deletion happens after the
+transaction, and forget them.
+*/
+func (self *PendingDels) Flush(c TransactionContext) (err error) {
+	if keys := self.Take(); len(keys) > 0 {
+		return Del(c, keys...)
+	}
+	return
+}
+
+/*
+sleep will sleep for d, or return the error of c if it is done before that.
+*/
+func sleep(c context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.Done():
+		return c.Err()
+	}
+}
+
 /*
 delWithRetry will delete the keys from memcache. If it fails, it will retry.
 */
@@ -119,7 +305,9 @@ func delWithRetry(c TransactionContext, keys ...string) (err error) {
 		if err == nil {
 			break
 		}
-		time.Sleep(waitTime)
+		if cerr := sleep(c, waitTime); cerr != nil {
+			return utils.Errorf("Giving up deleting %+v: %v (last error %v)", keys, cerr, err)
+		}
 		waitTime = waitTime * 2
 	}
 	if err != nil {
@@ -180,7 +368,10 @@ Get will lookup key and load it into val.
 If c is in a transaction no lookup will take place.
 */
 func Get(c TransactionContext, key string, val interface{}) (found bool, err error) {
-	if !MemcacheEnabled {
+	if !Enabled(key) {
+		return
+	}
+	if err = c.Err(); err != nil {
 		return
 	}
 	if c.InTransaction() {
@@ -203,6 +394,29 @@ func Get(c TransactionContext, key string, val interface{}) (found bool, err err
 	return
 }
 
+/*
+Peek will lookup key and load it into val, like Get but also inside transactions and for disabled keys, and also report
+whether the entry is a cached miss stored by one of the Memoize functions, in which case val is not meaningful.
+
+It is meant for diagnostics, e.g. comparing cached values to their sources.
+*/
+func Peek(c TransactionContext, key string, val interface{}) (found, cachedMiss bool, err error) {
+	k, err := Keyify(key)
+	if err != nil {
+		return
+	}
+	item, err := Codec.Get(c, k, val)
+	if err == memcache.ErrCacheMiss {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+	found = true
+	cachedMiss = item.Flags&nilCache == nilCache
+	return
+}
+
 /*
 CAS will replace expected with replacement in memcache if expected is the current value.
 */
@@ -271,7 +485,9 @@ func codecSetWithRetry(c TransactionContext, codec memcache.Codec, item *memcach
 		if err == nil {
 			break
 		}
-		time.Sleep(waitTime)
+		if cerr := sleep(c, waitTime); cerr != nil {
+			return utils.Errorf("Giving up doing Codec.Set %#v: %v (last error %v)", item.Key, cerr, err)
+		}
 		waitTime *= 2
 	}
 	if err != nil {
@@ -282,7 +498,10 @@ func codecSetWithRetry(c TransactionContext, codec memcache.Codec, item *memcach
 }
 
 func putUntil(c TransactionContext, until *time.Duration, key string, val interface{}) (err error) {
-	if !MemcacheEnabled {
+	if !Enabled(key) {
+		return
+	}
+	if err = c.Err(); err != nil {
 		return
 	}
 	k, err := Keyify(key)
@@ -371,13 +590,14 @@ func Memoize(c TransactionContext, key string, destP interface{}, f func() (inte
 }
 
 /*
-memGetMulti will look for all provided keys, and load them into the destinatinoPointers.
+memGetMulti will look for all provided keys, using their hashes, and load them into the destinatinoPointers.
 
 It will return the memcache.Items it found, and any errors the lookups caused.
 
 If c is within a transaction no lookup will take place and errors will be slice of memcache.ErrCacheMiss.
+Keys that aren't Enabled will not be looked up, and their errors will be memcache.ErrCacheMiss.
 */
-func memGetMulti(c TransactionContext, keys []string, destinationPointers []interface{}) (items []*memcache.Item, errors appengine.MultiError) {
+func memGetMulti(c TransactionContext, keys []string, keyHashes []string, destinationPointers []interface{}) (items []*memcache.Item, errors appengine.MultiError) {
 	items = make([]*memcache.Item, len(keys))
 	errors = make(appengine.MultiError, len(keys))
 	if !MemcacheEnabled || c.InTransaction() {
@@ -387,7 +607,14 @@ func memGetMulti(c TransactionContext, keys []string, destinationPointers []inte
 		return
 	}
 
-	itemHash, err := memcache.GetMulti(c, keys)
+	enabledHashes := make([]string, 0, len(keyHashes))
+	for index, keyHash := range keyHashes {
+		if Enabled(keys[index]) {
+			enabledHashes = append(enabledHashes, keyHash)
+		}
+	}
+
+	itemHash, err := memcache.GetMulti(c, enabledHashes)
 	if err != nil {
 		log.Printf("Error doing GetMulti: %v", err)
 		for index, _ := range errors {
@@ -398,7 +625,7 @@ func memGetMulti(c TransactionContext, keys []string, destinationPointers []inte
 
 	var item *memcache.Item
 	var ok bool
-	for index, keyHash := range keys {
+	for index, keyHash := range keyHashes {
 		if item, ok = itemHash[keyHash]; ok {
 			items[index] = item
 			if err := Codec.Unmarshal(item.Value, destinationPointers[index]); err != nil {
@@ -411,6 +638,108 @@ func memGetMulti(c TransactionContext, keys []string, destinationPointers []inte
 	return
 }
 
+/*
+SingleFlight makes concurrent cache misses for the same key (in the same namespace) in this instance share one run of the
+generator function, instead of all running it. Generators are never shared inside transactions.
+
+Shared results are encoded with Codec and decoded into the destination of each waiting caller, so that no two callers
+share any data. Runs that fail because their context is done, or panic, are never shared, and the waiting callers run
+the generator function themselves instead.
+*/
+var SingleFlight = true
+
+/*
+OnMiss, if set, will be called with the (unhashed) key and how long the generator function took each time a cache miss
+makes the Memoize functions run a generator function, for example to record metrics or prefetch related keys.
+
+It is not called for misses that share the result of a concurrent run of the generator function.
+*/
+var OnMiss func(c TransactionContext, key string, elapsed time.Duration)
+
+type flight struct {
+	done    chan struct{}
+	waiters int
+	// shareable is true if the run finished without panicking or its context being done, and any result was encoded
+	shareable bool
+	encoded   []byte
+	duration  time.Duration
+	err       error
+}
+
+type flightGroup struct {
+	lock    sync.Mutex
+	flights map[string]*flight
+}
+
+var flights = &flightGroup{
+	flights: map[string]*flight{},
+}
+
+/*
+flightKey returns the key to share generator runs for keyHash under, which includes the namespace of c since the same
+memcache key in different namespaces are different entries.
+*/
+func flightKey(c context.Context, keyHash string) string {
+	return datastore.NewKey(c, "flight", keyHash, 0, nil).Namespace() + "/" + keyHash
+}
+
+/*
+do will run f and return its results, unless f is already running for key, in which case it will wait for that run and
+return its error, and its result encoded with Codec (or nil if it was nil), with shared set to true.
+
+If the run waited for isn't shareable, f is run again using the context of the waiting caller. ran is true if f was run by
+this call, and false if it shared another run or c was done before the run waited for finished.
+*/
+func (self *flightGroup) do(c context.Context, key string, f func() (interface{}, time.Duration, error)) (result interface{}, encoded []byte, duration time.Duration, shared, ran bool, err error) {
+	self.lock.Lock()
+	if existing, found := self.flights[key]; found {
+		existing.waiters++
+		self.lock.Unlock()
+		select {
+		case <-existing.done:
+		case <-c.Done():
+			err = c.Err()
+			return
+		}
+		if existing.shareable {
+			return nil, existing.encoded, existing.duration, true, false, existing.err
+		}
+		ran = true
+		result, duration, err = f()
+		return
+	}
+	current := &flight{
+		done: make(chan struct{}),
+	}
+	self.flights[key] = current
+	self.lock.Unlock()
+	// forget returns the number of waiters, and makes sure no more are added
+	forget := func() int {
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		if self.flights[key] == current {
+			delete(self.flights, key)
+		}
+		return current.waiters
+	}
+	defer func() {
+		forget()
+		close(current.done)
+	}()
+	ran = true
+	result, duration, err = f()
+	if forget() > 0 && c.Err() == nil {
+		current.duration, current.err = duration, err
+		current.shareable = true
+		if err == nil && !utils.IsNil(result) {
+			if current.encoded, err = Codec.Marshal(result); err != nil {
+				current.shareable = false
+			}
+		}
+	}
+	return
+}
+
 /*
 MemoizeMulti will look for all provided keys, and load them into the destinationPointers.
 
@@ -444,6 +773,15 @@ func memoizeMulti(
 	destinationPointers []interface{},
 	generatorFunctions []func() (interface{}, time.Duration, error)) (errors appengine.MultiError) {
 
+	// Don't bother if the request is already cancelled.
+	if err := c.Err(); err != nil {
+		errors = make(appengine.MultiError, len(keys))
+		for index := range errors {
+			errors[index] = err
+		}
+		return
+	}
+
 	// First generate memcache friendly key hashes from all the provided keys.
 	keyHashes := make([]string, len(keys))
 	for index, key := range keys {
@@ -458,7 +796,7 @@ func memoizeMulti(
 	// Then, run a memGetMulti using these keys, and warn if it is slow.
 	t := time.Now()
 	var items []*memcache.Item
-	items, errors = memGetMulti(c, keyHashes, destinationPointers)
+	items, errors = memGetMulti(c, keys, keyHashes, destinationPointers)
 	if d := time.Now().Sub(t); d > time.Millisecond*10 {
 		log.Printf("SLOW memGetMulti(%v): %v", keys, d)
 	}
@@ -489,16 +827,37 @@ func memoizeMulti(
 					}
 				}()
 				var result interface{}
+				var encoded []byte
 				var duration time.Duration
+				shared := false
+				ran := true
 				found := true
-				// try to run the generator function
-				if result, duration, err = generatorFunctions[index](); err != nil {
+				// try to run the generator function, or wait for a concurrent run of it outside transactions
+				generateStart := time.Now()
+				if c.InTransaction() || !SingleFlight {
+					result, duration, err = generatorFunctions[index]()
+				} else {
+					result, encoded, duration, shared, ran, err = flights.do(c, flightKey(c, keyHash), generatorFunctions[index])
+				}
+				if OnMiss != nil && ran {
+					OnMiss(c, keys[index], time.Since(generateStart))
+				}
+				if err != nil {
 					if err != memcache.ErrCacheMiss {
 						return
 					} else {
 						// ErrCacheMiss from the generator function means that we want the caller to think there is no data to return
 						found = false
 					}
+				} else if shared {
+					// shared results are decoded into our own destination, so that we don't share any data with other callers
+					if found = encoded != nil; found {
+						if err = Codec.Unmarshal(encoded, destinationPointer); err != nil {
+							return
+						}
+						return
+					}
+					err = memcache.ErrCacheMiss
 				} else {
 					// if there is no error, check if we got a nil
 					found = !utils.IsNil(result)
@@ -507,8 +866,8 @@ func memoizeMulti(
 						err = memcache.ErrCacheMiss
 					}
 				}
-				// If we are not inside a transaction, we have to store the result in memcache
-				if !c.InTransaction() && (found || cacheNil) {
+				// If we are not inside a transaction, and didn't share the result of another run, we have to store the result in memcache
+				if !c.InTransaction() && !shared && (found || cacheNil) && Enabled(keys[index]) {
 					obj := result
 					var flags uint32
 					if !found {
@@ -31,10 +31,55 @@ var processors = []string{
 	AfterDeleteName,
 }
 
+/*
+ValueContext is a PersistenceContext that can return a copy of itself, of the same concrete type, whose Value method
+returns val for key.
+*/
+type ValueContext interface {
+	PersistenceContext
+	WithValue(key, val interface{}) PersistenceContext
+}
+
+type withoutAfterLoadKey struct{}
+
+/*
+withoutAfterLoad is a PersistenceContext that doesn't run any AfterLoad processors, for contexts that aren't ValueContexts.
+*/
+type withoutAfterLoad struct {
+	PersistenceContext
+}
+
+/*
+WithoutAfterLoad returns a context that makes GetById, GetMulti, GetQuery and the finders skip running AfterLoad on the loaded models.
+
+This bypasses any denormalization the models do in AfterLoad, so only use it for reads that only need the raw stored fields,
+such as bulk exports.
+
+If c is a ValueContext the returned context is a copy of c, so that it still implements the same optional interfaces
+(like EntityGroupTracker). Other contexts are wrapped, and lose their optional interfaces.
+*/
+func WithoutAfterLoad(c PersistenceContext) PersistenceContext {
+	if valueContext, ok := c.(ValueContext); ok {
+		return valueContext.WithValue(withoutAfterLoadKey{}, true)
+	}
+	return withoutAfterLoad{c}
+}
+
+// skipAfterLoad returns whether c was created by WithoutAfterLoad.
+func skipAfterLoad(c PersistenceContext) bool {
+	if _, wrapped := c.(withoutAfterLoad); wrapped {
+		return true
+	}
+	return c.Value(withoutAfterLoadKey{}) != nil
+}
+
 /*
 runProcess will run a function with name first on the provided context with model as parameter, then on model, passing it c and arg.
 */
 func runProcess(c PersistenceContext, model interface{}, name string, arg interface{}) error {
+	if name == AfterLoadName && skipAfterLoad(c) {
+		return nil
+	}
 	timer := time.Now()
 	typ := reflect.TypeOf(model)
 	// First run the method with name in the provided context
@@ -0,0 +1,107 @@
+package gae
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zond/sybutils/utils/web/httpcontext"
+
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	// OrderParam is the query parameter QueryFromParams reads orders from, as a comma separated list of fields prefixed with "-" for descending order.
+	OrderParam = "order"
+)
+
+// IgnoredQueryParams are the query parameters QueryFromParams doesn't treat as filters, e.g. because they are used for paging.
+var IgnoredQueryParams = []string{"offset", "limit", "cursor", "token"}
+
+/*
+QueryFromParams returns a query for the kind of model (a pointer to a struct) from params, where every parameter named like one of the filterable
+fields of model becomes an equality filter, and the OrderParam parameter orders by the orderable fields.
+
+Parameters naming other fields or orders, and values that can't be converted to the type of their field, will produce a 400 error.
+*/
+func QueryFromParams(model interface{}, params url.Values, filterable []string, orderable []string) (q *datastore.Query, err error) {
+	typ := reflect.TypeOf(model).Elem()
+	q = datastore.NewQuery(typ.Name())
+	allowed := func(allowedFields []string, name string) bool {
+		for _, allowedField := range allowedFields {
+			if allowedField == name {
+				return true
+			}
+		}
+		return false
+	}
+	for name, values := range params {
+		if name == OrderParam || allowed(IgnoredQueryParams, name) {
+			continue
+		}
+		field, found := typ.FieldByName(name)
+		if !found || !allowed(filterable, name) {
+			err = httpcontext.NewError(400, fmt.Sprintf("Unable to filter on %#v, only on %v", name, filterable), "", nil)
+			return
+		}
+		for _, value := range values {
+			var converted interface{}
+			if converted, err = convertQueryParam(field.Type, value); err != nil {
+				err = httpcontext.NewError(400, fmt.Sprintf("Unable to filter on %#v with %#v: %v", name, value, err), "", err)
+				return
+			}
+			q = q.Filter(fmt.Sprintf("%v=", name), converted)
+		}
+	}
+	for _, order := range strings.Split(params.Get(OrderParam), ",") {
+		if order == "" {
+			continue
+		}
+		if !allowed(orderable, strings.TrimPrefix(order, "-")) {
+			err = httpcontext.NewError(400, fmt.Sprintf("Unable to order by %#v, only by %v", order, orderable), "", nil)
+			return
+		}
+		q = q.Order(order)
+	}
+	return
+}
+
+/*
+convertQueryParam converts s to typ, for the field types that can be filtered on using query parameters.
+*/
+func convertQueryParam(typ reflect.Type, s string) (result interface{}, err error) {
+	if typ == reflect.TypeOf(time.Time{}) {
+		return time.Parse(time.RFC3339, s)
+	}
+	val := reflect.New(typ).Elem()
+	switch typ.Kind() {
+	case reflect.String:
+		val.SetString(s)
+	case reflect.Bool:
+		var b bool
+		if b, err = strconv.ParseBool(s); err != nil {
+			return
+		}
+		val.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		if i, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return
+		}
+		val.SetInt(i)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(s, 64); err != nil {
+			return
+		}
+		val.SetFloat(f)
+	default:
+		err = fmt.Errorf("Unable to filter on fields of type %v", typ)
+		return
+	}
+	result = val.Interface()
+	return
+}
@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"strings"
+)
+
+/*
+isoCountries are the officially assigned ISO 3166-1 alpha-2 country codes.
+*/
+var isoCountries = map[string]bool{}
+
+func init() {
+	for _, country := range strings.Fields(`
+AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ
+BA BB BD BE BF BG BH BI BJ BL BM BN BO BQ BR BS BT BV BW BY BZ
+CA CC CD CF CG CH CI CK CL CM CN CO CR CU CV CW CX CY CZ
+DE DJ DK DM DO DZ
+EC EE EG EH ER ES ET
+FI FJ FK FM FO FR
+GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY
+HK HM HN HR HT HU
+ID IE IL IM IN IO IQ IR IS IT
+JE JM JO JP
+KE KG KH KI KM KN KP KR KW KY KZ
+LA LB LC LI LK LR LS LT LU LV LY
+MA MC MD ME MF MG MH MK ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ
+NA NC NE NF NG NI NL NO NP NR NU NZ
+OM
+PA PE PF PG PH PK PL PM PN PR PS PT PW PY
+QA
+RE RO RS RU RW
+SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ
+TC TD TF TG TH TJ TK TL TM TN TO TR TT TV TW TZ
+UA UG UM US UY UZ
+VA VC VE VG VI VN VU
+WF WS
+YE YT
+ZA ZM ZW`) {
+		isoCountries[country] = true
+	}
+}
+
+/*
+NormalizeISOCountry returns s as an upper case ISO 3166-1 alpha-2 country code, or an error if it isn't one.
+*/
+func NormalizeISOCountry(s string) (result string, err error) {
+	result = strings.ToUpper(strings.TrimSpace(s))
+	if !isoCountries[result] {
+		err = Errorf("%#v is not an ISO 3166-1 alpha-2 country code", s)
+	}
+	return
+}
+
+/*
+NormalizeLocale returns s as a locale like "sv" or "sv_SE", with a lower case language and an optional upper case ISO country,
+or an error if it isn't one.
+
+Both "-" and "_" are accepted as separators. The language is only checked to be two or three letters, not that it is an assigned
+ISO 639 code.
+*/
+func NormalizeLocale(s string) (result string, err error) {
+	parts := strings.Split(strings.Replace(strings.TrimSpace(s), "-", "_", -1), "_")
+	if len(parts) > 2 {
+		err = Errorf("%#v is not a locale", s)
+		return
+	}
+	language := strings.ToLower(parts[0])
+	if len(language) < 2 || len(language) > 3 {
+		err = Errorf("%#v doesn't have a two or three letter language", s)
+		return
+	}
+	for _, r := range language {
+		if r < 'a' || r > 'z' {
+			err = Errorf("%#v doesn't have a two or three letter language", s)
+			return
+		}
+	}
+	result = language
+	if len(parts) == 2 {
+		var country string
+		if country, err = NormalizeISOCountry(parts[1]); err != nil {
+			return
+		}
+		result += "_" + country
+	}
+	return
+}
@@ -42,3 +42,27 @@ func ToGAE(c context.Context, k key.Key) *datastore.Key {
 	kind, stringID, intID, parent := k.Split()
 	return datastore.NewKey(c, kind, stringID, intID, ToGAE(c, key.Key(parent)))
 }
+
+/*
+ToGAEMulti converts all ids to datastore keys.
+*/
+func ToGAEMulti(c context.Context, ids []key.Key) (result []*datastore.Key) {
+	result = make([]*datastore.Key, len(ids))
+	for index, id := range ids {
+		result[index] = ToGAE(c, id)
+	}
+	return
+}
+
+/*
+FromGAEMulti converts all datastore keys to ids, failing on the first invalid key.
+*/
+func FromGAEMulti(ks []*datastore.Key) (result []key.Key, err error) {
+	result = make([]key.Key, len(ks))
+	for index, k := range ks {
+		if result[index], err = FromGAE(k); err != nil {
+			return
+		}
+	}
+	return
+}
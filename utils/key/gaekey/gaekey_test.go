@@ -0,0 +1,55 @@
+package gaekey
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/zond/sybutils/utils/key"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func mustKey(t *testing.T, kind, stringID string, intID int64, parent key.Key) key.Key {
+	k, err := key.New(kind, stringID, intID, parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestFromGAEMulti(t *testing.T) {
+	// datastore.NewKey needs an app id, which outside App Engine is read from the environment
+	t.Setenv("GAE_APPLICATION", "test")
+	c := context.Background()
+	grandParent := mustKey(t, "GrandParent", "granny", 0, "")
+	parent := mustKey(t, "Parent", "", 12, grandParent)
+	ids := []key.Key{
+		grandParent,
+		parent,
+		mustKey(t, "Child", "kid", 0, parent),
+		mustKey(t, "Child", "", 34, parent),
+		mustKey(t, "Orphan", "", 56, ""),
+	}
+	ks := ToGAEMulti(c, ids)
+	if len(ks) != len(ids) {
+		t.Fatalf("Wanted %v keys, got %v", len(ids), len(ks))
+	}
+	wanted := datastore.NewKey(c, "Child", "", 34, datastore.NewKey(c, "Parent", "", 12, datastore.NewKey(c, "GrandParent", "granny", 0, nil)))
+	if !ks[3].Equal(wanted) {
+		t.Errorf("Wanted %v, got %v", wanted, ks[3])
+	}
+	found, err := FromGAEMulti(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, ids) {
+		t.Errorf("Wanted %v, got %v", ids, found)
+	}
+	if found, err = FromGAEMulti([]*datastore.Key{ks[0], nil}); err != nil {
+		t.Fatal(err)
+	}
+	if found[1] != "" {
+		t.Errorf("Wanted an empty id for a nil key, got %v", found[1])
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"net/url"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -42,6 +44,31 @@ func AssertedKinds() (result []string) {
 	for kind, _ := range genealogyAssertions {
 		result = append(result, kind)
 	}
+	sort.Strings(result)
+	return
+}
+
+/*
+Genealogy describes the rules asserted for a kind, empty ParentKinds or StringIDKinds meaning that anything is allowed.
+*/
+type Genealogy struct {
+	Kind          string
+	ParentKinds   []string
+	StringIDKinds []string
+}
+
+/*
+Genealogies returns the rules asserted for all kinds with AssertGenealogy, sorted by kind.
+*/
+func Genealogies() (result []Genealogy) {
+	for _, kind := range AssertedKinds() {
+		assertion := genealogyAssertions[kind]
+		result = append(result, Genealogy{
+			Kind:          kind,
+			ParentKinds:   append([]string{}, assertion.parentKinds...),
+			StringIDKinds: append([]string{}, assertion.stringIDKinds...),
+		})
+	}
 	return
 }
 
@@ -142,7 +169,11 @@ func New(kind string, stringID string, intID int64, parent Key) (result Key, err
 }
 
 func (self Key) validate() (err error) {
-	kind, stringID, _, parent := self.Split()
+	kind, stringID, intID, parent := self.Split()
+	if stringID != "" && intID != 0 {
+		err = utils.Errorf("%v has both StringID %#v and IntID %v, but can only have one of them", self.Path(), stringID, intID)
+		return
+	}
 	if assertion, found := genealogyAssertions[kind]; found {
 		if len(assertion.parentKinds) > 0 {
 			parentKind := parent.Kind()
@@ -154,7 +185,7 @@ func (self Key) validate() (err error) {
 				}
 			}
 			if !ok {
-				err = utils.Errorf("%v doesn't have a valid parent", self)
+				err = utils.Errorf("%v doesn't have a valid parent", self.Path())
 				return
 			}
 		}
@@ -172,7 +203,7 @@ func (self Key) validate() (err error) {
 				}
 			}
 			if !ok {
-				err = utils.Errorf("%v doesn't have a valid StringID", self)
+				err = utils.Errorf("%v doesn't have a valid StringID", self.Path())
 				return
 			}
 		}
@@ -189,6 +220,25 @@ func (self Key) String() string {
 	return string(buf.Bytes())
 }
 
+/*
+Path returns a human readable description of the key and its ancestors, like "Account:fg/Location:ff/SoundZone:12345",
+for use in logs and error messages.
+*/
+func (self Key) Path() string {
+	if len(self) == 0 {
+		return ""
+	}
+	kind, stringID, intID, parent := self.Split()
+	id := stringID
+	if intID != 0 {
+		id = fmt.Sprint(intID)
+	}
+	if parent == "" {
+		return fmt.Sprintf("%v:%v", kind, id)
+	}
+	return fmt.Sprintf("%v/%v:%v", parent.Path(), kind, id)
+}
+
 func (self Key) Split() (kind string, stringID string, intID int64, parent Key) {
 	rest, after := split(string(self), '/')
 	kind, rest = split(rest, ',')
@@ -261,6 +311,40 @@ func (self Key) Encode() (result string) {
 	return strings.Replace(base64.URLEncoding.EncodeToString([]byte(self)), "=", ".", -1)
 }
 
+/*
+ReadableEncode will encode the key by percent-encoding everything but unreserved URL characters and commas, keeping
+kinds and ids legible in logs and URLs. Encode is still the format to use in APIs.
+*/
+func (self Key) ReadableEncode() (result string) {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(self); i++ {
+		c := self[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || strings.IndexByte("-_.~,", c) != -1 {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+/*
+ReadableDecode will decode a key encoded with ReadableEncode.
+*/
+func ReadableDecode(s string) (result Key, err error) {
+	if s == "" {
+		return
+	}
+	decoded, err := url.PathUnescape(s)
+	if err != nil {
+		err = httpcontext.NewError(400, err.Error(), err.Error(), err)
+		return
+	}
+	result = Key(decoded)
+	err = result.validate()
+	return
+}
+
 func DecodeKind(kind string, s string) (result Key, err error) {
 	if result, err = Decode(s); err != nil {
 		return
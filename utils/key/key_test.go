@@ -23,15 +23,23 @@ func randomString() string {
 	return string(buf)
 }
 
+func randomIDs() (stringID string, intID int64) {
+	if rand.Int()%2 == 0 {
+		return randomString(), 0
+	}
+	return "", rand.Int63()
+}
+
 func randomKey(parents int) Key {
+	stringID, intID := randomIDs()
 	if parents == 0 {
-		key, err := New(randomString(), randomString(), rand.Int63(), "")
+		key, err := New(randomString(), stringID, intID, "")
 		if err != nil {
 			panic(err)
 		}
 		return key
 	}
-	key, err := New(randomString(), randomString(), rand.Int63(), randomKey(parents-1))
+	key, err := New(randomString(), stringID, intID, randomKey(parents-1))
 	if err != nil {
 		panic(err)
 	}
@@ -86,6 +94,27 @@ func TestEncodeDecode(t *testing.T) {
 	}
 }
 
+func TestReadableEncodeDecode(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		k := randomKey(2)
+		enc := k.ReadableEncode()
+		k2, err := ReadableDecode(enc)
+		if err != nil {
+			t.Fatalf("Failed decoding %s: %v", enc, err)
+		}
+		if !reflect.DeepEqual(k, k2) {
+			t.Fatalf("%#v != %#v", k, k2)
+		}
+	}
+	k, err := New("Account", "", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enc := k.ReadableEncode(); enc != "Account,,a%2F" {
+		t.Errorf("Wanted Account,,a%%2F, got %v", enc)
+	}
+}
+
 type testWrapper struct {
 	Id   Key
 	Name string
@@ -154,6 +183,21 @@ func TestValidations(t *testing.T) {
 	}
 }
 
+func TestBothIDs(t *testing.T) {
+	if _, err := New("Account", "fg", 1, ""); err == nil {
+		t.Fatalf("should not work")
+	}
+	if _, err := Decode(NewWithoutValidate("Account", "fg", 1, "").Encode()); err == nil {
+		t.Fatalf("should not work")
+	}
+	if _, err := New("Account", "fg", 0, ""); err != nil {
+		t.Fatalf("should work")
+	}
+	if _, err := New("Account", "", 1, ""); err != nil {
+		t.Fatalf("should work")
+	}
+}
+
 func TestToAndFromJSON(t *testing.T) {
 	for i := 0; i < 1000; i++ {
 		k := randomKey(5)
@@ -200,3 +244,24 @@ func TestNilKeys(t *testing.T) {
 		t.Fatalf("wtf")
 	}
 }
+
+func TestPath(t *testing.T) {
+	parent := NewWithoutValidate("Account", "fg", 0, "")
+	k := NewWithoutValidate("SoundZone", "", 12345, NewWithoutValidate("Location", "ff", 0, parent))
+	if path := k.Path(); path != "Account:fg/Location:ff/SoundZone:12345" {
+		t.Errorf("Wanted Account:fg/Location:ff/SoundZone:12345, got %v", path)
+	}
+	if path := Key("").Path(); path != "" {
+		t.Errorf("Wanted empty path, got %v", path)
+	}
+}
+
+func TestGenealogies(t *testing.T) {
+	wanted := []Genealogy{
+		{Kind: "Location", ParentKinds: []string{"Account"}, StringIDKinds: []string{}},
+		{Kind: "SpotifyAccount", ParentKinds: []string{}, StringIDKinds: []string{"Location"}},
+	}
+	if found := Genealogies(); !reflect.DeepEqual(found, wanted) {
+		t.Errorf("Wanted %+v, got %+v", wanted, found)
+	}
+}
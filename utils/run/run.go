@@ -4,14 +4,58 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 )
 
 var Host = "LOCAL"
 
+/*
+Logger is the part of utils.Logger used by this package, which can't import utils without causing an import cycle.
+*/
+type Logger interface {
+	Infof(format string, args ...interface{})
+}
+
+/*
+stdoutLogger is the default Logger, printing to stdout.
+*/
+type stdoutLogger struct{}
+
+func (self stdoutLogger) Infof(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+}
+
+// Log is where the commands run by this package are echoed.
+var Log Logger = stdoutLogger{}
+
+/*
+Echo will log that path is being run with args on host, followed by suffix.
+*/
+func Echo(host, path string, args []string, suffix string) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, " ( *** %v ) %v", host, path)
+	for _, bit := range args {
+		fmt.Fprintf(buf, " %#v", bit)
+	}
+	buf.WriteString(suffix)
+	Log.Infof("%s", buf.String())
+}
+
+type MultiError []error
+
+func (self MultiError) Error() string {
+	s := make([]string, len(self))
+	for index, err := range self {
+		s[index] = err.Error()
+	}
+	return strings.Join(s, ", ")
+}
+
 type StderrError string
 
 func (self StderrError) Error() string {
@@ -19,14 +63,60 @@ func (self StderrError) Error() string {
 }
 
 func Start(path string, args ...string) (result chan error) {
-	return startAndLog("", path, args...)
+	return startAndLog("", nil, path, args...)
 }
 
 func StartAndLog(logfile string, path string, args ...string) (result chan error) {
-	return startAndLog(logfile, path, args...)
+	return startAndLog(logfile, nil, path, args...)
+}
+
+/*
+prefixWriter writes each complete line written to it to w, prefixed with prefix.
+
+Several prefixWriters sharing the same lock can write to the same w without interleaving their lines.
+*/
+type prefixWriter struct {
+	w      io.Writer
+	lock   *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func (self *prefixWriter) Write(b []byte) (n int, err error) {
+	self.buf = append(self.buf, b...)
+	for {
+		index := bytes.IndexByte(self.buf, '\n')
+		if index == -1 {
+			break
+		}
+		if err = self.writeLine(self.buf[:index+1]); err != nil {
+			return
+		}
+		self.buf = self.buf[index+1:]
+	}
+	return len(b), nil
 }
 
-func startAndLog(logfile string, path string, args ...string) (result chan error) {
+func (self *prefixWriter) writeLine(line []byte) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, err = fmt.Fprintf(self.w, "[%v] %s", self.prefix, line)
+	return
+}
+
+/*
+Flush writes any incomplete last line.
+*/
+func (self *prefixWriter) Flush() (err error) {
+	if len(self.buf) == 0 {
+		return
+	}
+	err = self.writeLine(append(self.buf, '\n'))
+	self.buf = nil
+	return
+}
+
+func startAndLog(logfile string, tee *prefixWriter, path string, args ...string) (result chan error) {
 	result = make(chan error, 1)
 
 	var file *os.File
@@ -38,20 +128,19 @@ func startAndLog(logfile string, path string, args ...string) (result chan error
 		}
 	}
 
-	fmt.Printf(" ( *** %v ) %v", Host, path)
-	for _, bit := range args {
-		fmt.Printf(" %#v", bit)
-	}
 	if logfile != "" {
-		fmt.Printf(" > %#v\n", logfile)
+		Echo(Host, path, args, fmt.Sprintf(" > %#v", logfile))
 	} else {
-		fmt.Printf("\n")
+		Echo(Host, path, args, "")
 	}
 
 	cmd := exec.Command(path, args...)
 
 	cmd.Stdin = os.Stdin
-	if logfile != "" {
+	if logfile != "" && tee != nil {
+		cmd.Stdout = io.MultiWriter(file, tee)
+		cmd.Stderr = cmd.Stdout
+	} else if logfile != "" {
 		cmd.Stdout, cmd.Stderr = file, file
 	} else {
 		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
@@ -65,18 +154,18 @@ func startAndLog(logfile string, path string, args ...string) (result chan error
 		if logfile != "" {
 			defer file.Close()
 		}
-		result <- cmd.Wait()
+		err := cmd.Wait()
+		if tee != nil {
+			tee.Flush()
+		}
+		result <- err
 	}()
 
 	return
 }
 
 func RunAndReturn(path string, params ...string) (stdout, stderr string, err error) {
-	fmt.Printf(" ( *** %v ) %v", Host, path)
-	for _, bit := range params {
-		fmt.Printf(" %#v", bit)
-	}
-	fmt.Println("")
+	Echo(Host, path, params, "")
 
 	cmd := exec.Command(path, params...)
 	o := new(bytes.Buffer)
@@ -103,11 +192,7 @@ func run(silent bool, path string, params ...string) (err error) {
 	} else {
 		cmd.Stderr = io.MultiWriter(buf, os.Stderr)
 		cmd.Stdin, cmd.Stdout = os.Stdin, os.Stdout
-		fmt.Printf(" ( *** %v ) %v", Host, path)
-		for _, bit := range params {
-			fmt.Printf(" %#v", bit)
-		}
-		fmt.Println("")
+		Echo(Host, path, params, "")
 	}
 	err = cmd.Run()
 	if strings.TrimSpace(string(buf.Bytes())) != "" {
@@ -126,9 +211,43 @@ type CommandSet struct {
 	TMux        bool
 	SessionName string
 	Detach      bool
+	// Tee makes the non tmux mode also print the output of each command to stdout, prefixed with its name.
+	Tee bool
 }
 
+/*
+CommandResult is the outcome of one of the commands of a CommandSet run in parallel without tmux.
+*/
+type CommandResult struct {
+	Command  []string
+	Name     string
+	Err      error
+	ExitCode int
+	Output   string
+}
+
+/*
+InParallel will run all the commands of the set in parallel.
+
+Without TMux and Detach, it waits for the commands to finish and returns the error of the first one (in order) that failed.
+*/
 func (self *CommandSet) InParallel() (err error) {
+	results, err := self.InParallelResults()
+	for _, result := range results {
+		if result.Err != nil {
+			return result.Err
+		}
+	}
+	return
+}
+
+/*
+InParallelResults will run all the commands of the set in parallel, like InParallel.
+
+Without TMux and Detach, it waits for all commands to finish and returns their results, along with a MultiError
+of the commands that failed.
+*/
+func (self *CommandSet) InParallelResults() (results []CommandResult, err error) {
 	if self.TMux {
 
 		if self.SessionName == "" {
@@ -187,17 +306,53 @@ func (self *CommandSet) InParallel() (err error) {
 	} else {
 		// Start all background processes, logging to files.
 		var procs []chan error
-		for _, command := range self.Commands {
-			procs = append(procs, StartAndLog(fmt.Sprintf("%v.log", strings.Join(command, " ")), command[0], command[1:]...))
+		stdoutLock := &sync.Mutex{}
+		for index, command := range self.Commands {
+			result := CommandResult{
+				Command: command,
+			}
+			if len(self.Names) > index {
+				result.Name = self.Names[index]
+			}
+			results = append(results, result)
+			var tee *prefixWriter
+			if self.Tee {
+				tee = &prefixWriter{
+					w:      os.Stdout,
+					lock:   stdoutLock,
+					prefix: fmt.Sprintf("cmd%v", index),
+				}
+				if len(self.Names) > index {
+					tee.prefix = self.Names[index]
+				}
+			}
+			procs = append(procs, startAndLog(logfileFor(command), tee, command[0], command[1:]...))
 		}
 		if !self.Detach {
 			// Wait for all subprocesses to quit.
-			for _, p := range procs {
-				if err = <-p; err != nil {
-					return
+			merr := MultiError{}
+			for index, p := range procs {
+				result := &results[index]
+				if result.Err = <-p; result.Err != nil {
+					result.ExitCode = -1
+					if exitErr, ok := result.Err.(*exec.ExitError); ok {
+						result.ExitCode = exitErr.ExitCode()
+					}
+					merr = append(merr, fmt.Errorf("%v: %v", strings.Join(result.Command, " "), result.Err))
+				}
+				if output, err := ioutil.ReadFile(logfileFor(result.Command)); err == nil {
+					result.Output = string(output)
 				}
 			}
+			if len(merr) > 0 {
+				err = merr
+				return
+			}
 		}
 	}
 	return
 }
+
+func logfileFor(command []string) string {
+	return fmt.Sprintf("%v.log", strings.Join(command, " "))
+}
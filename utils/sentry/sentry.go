@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/zond/sybutils/utils"
@@ -16,6 +17,9 @@ import (
 	"encoding/json"
 )
 
+// Log is where failures to send to Sentry outside the call that caused them are logged.
+var Log utils.Logger = utils.StdLogger{}
+
 type Sentry struct {
 	projectId  string
 	url        string
@@ -34,15 +38,94 @@ const (
 	FATAL            = "fatal"
 )
 
+var Severities = utils.NewEnumValidator("Severity", string(DEBUG), INFO, WARNING, ERROR, FATAL)
+
+func (self Severity) Validate() error {
+	return Severities.Validate(string(self))
+}
+
+func (self Severity) MarshalJSON() ([]byte, error) {
+	return Severities.Marshal(string(self))
+}
+
 type Packet struct {
-	EventId    string      `json:"event_id"`  // Unique id, max 32 characters
-	Timestamp  time.Time   `json:"timestamp"` // Sentry assumes it is given in UTC. Use the ISO 8601 format
-	Message    string      `json:"message"`   // Human-readable message, max length 1000 characters
-	Level      Severity    `json:"level"`     // Defaults to "error"
-	Logger     string      `json:"logger"`    // Defaults to "root"
-	Culprit    string      `json:"culprit"`   // Becomes main name in Sentry
-	ServerName string      `json:"server_name"`
-	Tags       interface{} `json:"tags,omitempty"` // Additional optional tags
+	EventId     string                 `json:"event_id"`  // Unique id, max 32 characters
+	Timestamp   time.Time              `json:"timestamp"` // Sentry assumes it is given in UTC. Use the ISO 8601 format
+	Message     string                 `json:"message"`   // Human-readable message, max length 1000 characters
+	Level       Severity               `json:"level"`     // Defaults to "error"
+	Logger      string                 `json:"logger"`    // Defaults to "root"
+	Culprit     string                 `json:"culprit"`   // Becomes main name in Sentry
+	ServerName  string                 `json:"server_name"`
+	Tags        interface{}            `json:"tags,omitempty"` // Additional optional tags
+	Stacktrace  *Stacktrace            `json:"stacktrace,omitempty"`
+	Fingerprint []string               `json:"fingerprint,omitempty"` // Groups events in Sentry, and in Deduper
+	Extra       map[string]interface{} `json:"extra,omitempty"`
+}
+
+type Frame struct {
+	Filename string `json:"filename"`
+	Function string `json:"function"`
+	Module   string `json:"module"`
+	Lineno   int    `json:"lineno"`
+}
+
+// Stacktrace is the Sentry stacktrace interface. Sentry wants the frames ordered with the most recent call last.
+type Stacktrace struct {
+	Frames []Frame `json:"frames"`
+}
+
+/*
+NewStacktrace parses stack, as produced by utils.Stack or utils.StackError#GetStack, into a Stacktrace.
+*/
+func NewStacktrace(stack string) (result *Stacktrace) {
+	frames := utils.ParseStack(stack)
+	result = &Stacktrace{
+		Frames: make([]Frame, len(frames)),
+	}
+	for index, frame := range frames {
+		result.Frames[len(frames)-1-index] = Frame{
+			Filename: frame.File,
+			Function: frame.Function,
+			Module:   frame.Package,
+			Lineno:   frame.Line,
+		}
+	}
+	return
+}
+
+/*
+NewPacket returns a packet for err, with a Stacktrace if err is a utils.StackError.
+*/
+func NewPacket(err error) (result *Packet) {
+	result = &Packet{
+		Message: err.Error(),
+	}
+	if defaultErr, ok := err.(utils.DefaultStackError); ok {
+		result.Message = defaultErr.Source.Error()
+	}
+	if stackErr, ok := err.(utils.StackError); ok {
+		result.Stacktrace = NewStacktrace(stackErr.GetStack())
+	}
+	return
+}
+
+/*
+NewPanicReporter returns a function suitable as httpcontext.PanicReporter, sending the panics to the Sentry at dsn
+with the request id, method and URL as extra information.
+*/
+func NewPanicReporter(client *http.Client, dsn string) func(r *http.Request, requestID string, err utils.StackError) {
+	return func(r *http.Request, requestID string, err utils.StackError) {
+		packet := NewPacket(err)
+		packet.Level = FATAL
+		packet.Extra = map[string]interface{}{
+			"request_id": requestID,
+			"method":     r.Method,
+			"url":        r.URL.String(),
+		}
+		if sendErr := SendError(client, &Error{Dsn: dsn, Packet: packet}); sendErr != nil {
+			Log.Errorf("Unable to send panic to Sentry: %v", sendErr)
+		}
+	}
 }
 
 type Error struct {
@@ -51,9 +134,13 @@ type Error struct {
 }
 
 /*
-Sends error to Sentry
+Sends error to Sentry, through DefaultDeduper.
 */
 func SendError(client *http.Client, serr *Error) (err error) {
+	return DefaultDeduper.SendError(client, serr)
+}
+
+func sendError(client *http.Client, serr *Error) (err error) {
 	sentry, err := newSentry(client, serr.Dsn)
 	if err != nil {
 		return
@@ -70,6 +157,114 @@ func SendError(client *http.Client, serr *Error) (err error) {
 	return
 }
 
+/*
+Deduper sends errors to Sentry, but suppresses errors with the same fingerprint as an error successfully sent within
+Window. The number of suppressed occurrences is sent as a single aggregated error, using the client of the next
+SendError after the window closed, or by Flush.
+
+Errors without a Packet.Fingerprint, and all errors if Window is zero, are always sent.
+*/
+type Deduper struct {
+	Window  time.Duration
+	lock    sync.Mutex
+	windows map[string]*dedupWindow
+}
+
+type dedupWindow struct {
+	serr       *Error
+	openedAt   time.Time
+	suppressed int
+}
+
+/*
+DefaultDeduper is used by SendError, and doesn't suppress anything until its Window is set.
+*/
+var DefaultDeduper = &Deduper{}
+
+func NewDeduper(window time.Duration) *Deduper {
+	return &Deduper{
+		Window: window,
+	}
+}
+
+/*
+SendError will send serr to Sentry using client, unless an error with the same fingerprint was sent within the dedup
+window. It will also send aggregated errors for any closed windows with suppressed errors.
+*/
+func (self *Deduper) SendError(client *http.Client, serr *Error) (err error) {
+	now := time.Now()
+	self.sendAggregates(client, self.takeWindows(func(window *dedupWindow) bool {
+		return now.Sub(window.openedAt) >= self.Window
+	}))
+	if self.Window <= 0 || serr.Packet == nil || len(serr.Packet.Fingerprint) == 0 {
+		return sendError(client, serr)
+	}
+	fingerprint := serr.Dsn + "\x00" + strings.Join(serr.Packet.Fingerprint, "\x00")
+	self.lock.Lock()
+	if window, found := self.windows[fingerprint]; found {
+		window.suppressed++
+		self.lock.Unlock()
+		return
+	}
+	self.lock.Unlock()
+	if err = sendError(client, serr); err != nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.windows == nil {
+		self.windows = map[string]*dedupWindow{}
+	}
+	if _, found := self.windows[fingerprint]; !found {
+		self.windows[fingerprint] = &dedupWindow{
+			serr:     serr,
+			openedAt: now,
+		}
+	}
+	return
+}
+
+/*
+Flush will close all dedup windows, and send aggregated errors for those with suppressed errors using client.
+*/
+func (self *Deduper) Flush(client *http.Client) {
+	self.sendAggregates(client, self.takeWindows(func(window *dedupWindow) bool {
+		return true
+	}))
+}
+
+// takeWindows removes and returns the windows matching f.
+func (self *Deduper) takeWindows(f func(window *dedupWindow) bool) (result []*dedupWindow) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for fingerprint, window := range self.windows {
+		if f(window) {
+			delete(self.windows, fingerprint)
+			result = append(result, window)
+		}
+	}
+	return
+}
+
+// sendAggregates sends an aggregated error for each of windows with suppressed errors.
+func (self *Deduper) sendAggregates(client *http.Client, windows []*dedupWindow) {
+	for _, window := range windows {
+		if window.suppressed == 0 {
+			continue
+		}
+		packet := *window.serr.Packet
+		packet.Extra = map[string]interface{}{}
+		for k, v := range window.serr.Packet.Extra {
+			packet.Extra[k] = v
+		}
+		packet.Extra["suppressed_occurrences"] = window.suppressed
+		packet.Extra["dedup_window"] = self.Window.String()
+		if err := sendError(client, &Error{Dsn: window.serr.Dsn, Packet: &packet}); err != nil {
+			Log.Errorf("Sentry: unable to send aggregated error for %v suppressed occurrences of %#v: %v", window.suppressed, packet.Message, err)
+		}
+	}
+}
+
 func newSentry(client *http.Client, dsn string) (sentry *Sentry, err error) {
 	if dsn == "" {
 		return
@@ -155,12 +350,8 @@ func (self *Packet) init() (err error) {
 	if self.Level == "" {
 		self.Level = ERROR
 	}
-	if self.Level != DEBUG &&
-		self.Level != INFO &&
-		self.Level != WARNING &&
-		self.Level != ERROR &&
-		self.Level != FATAL {
-		return utils.Errorf("Sentry: packet.Level value not valid")
+	if err = self.Level.Validate(); err != nil {
+		return
 	}
 	if self.Message == "" {
 		return utils.Errorf("Sentry: packet.Message missing")
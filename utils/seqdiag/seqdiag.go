@@ -16,6 +16,7 @@ type Arrow struct {
 	Label string
 	Color string
 	Type  string
+	rank  int
 }
 
 type Doc struct {
@@ -23,14 +24,19 @@ type Doc struct {
 	services  []*Service
 	notes     map[string]string
 	endPoints map[string]bool
+	ranks     int
+	parallels []int
 	Label     string
 	Flows     []*Flow
 }
 
 type Flow struct {
-	arrows []*Arrow
-	start  *Service
-	Color  string
+	arrows       []*Arrow
+	last         []*Arrow
+	start        *Service
+	parallel     *[]*Arrow
+	parallelRank int
+	Color        string
 }
 
 var colors []string
@@ -50,28 +56,70 @@ func init() {
 }
 
 func (s *Service) Add(t *Service, l string) *Flow {
+	return s.newFlow().Add(t, l)
+}
+
+func (s *Service) newFlow() *Flow {
 	f := &Flow{start: s, Color: colors[len(s.Doc.Flows)%len(colors)]}
 	s.Doc.Flows = append(s.Doc.Flows, f)
-	f.Add(t, l)
 	return f
 }
 
 func (self *Flow) Add(t *Service, l string) *Flow {
 	doc := self.start.Doc
-	doc.endPoints[fmt.Sprintf("%v_%v", self.start.Label, len(doc.arrows))] = true
-	doc.endPoints[fmt.Sprintf("%v_%v", t.Label, len(doc.arrows))] = true
-	arrow := &Arrow{From: self.start, To: t, Label: l, Color: self.Color, Type: "normal"}
-	self.start = t
+	rank := self.parallelRank
+	if self.parallel == nil {
+		rank = doc.ranks
+		doc.ranks++
+	}
+	doc.endPoints[fmt.Sprintf("%v_%v", self.start.Label, rank)] = true
+	doc.endPoints[fmt.Sprintf("%v_%v", t.Label, rank)] = true
+	arrow := &Arrow{From: self.start, To: t, Label: l, Color: self.Color, Type: "normal", rank: rank}
 	doc.arrows = append(doc.arrows, arrow)
 	self.arrows = append(self.arrows, arrow)
-	if len(self.arrows) > 1 {
-		self.arrows[len(self.arrows)-2].Type = "none"
+	if self.parallel != nil {
+		// parallel arrows all start from the same service, so the flow doesn't move on
+		*self.parallel = append(*self.parallel, arrow)
+		return self
+	}
+	for _, last := range self.last {
+		last.Type = "none"
+	}
+	self.last = []*Arrow{arrow}
+	self.start = t
+	return self
+}
+
+/*
+Parallel will run f with this flow, and make all arrows added by f happen concurrently: they all start from the
+current service, share the same rank, and are drawn in a shaded region.
+
+The flow continues from the current service afterwards.
+*/
+func (self *Flow) Parallel(f func(f *Flow)) *Flow {
+	if self.parallel != nil {
+		f(self)
+		return self
+	}
+	doc := self.start.Doc
+	group := []*Arrow{}
+	self.parallel = &group
+	self.parallelRank = doc.ranks
+	doc.ranks++
+	f(self)
+	self.parallel = nil
+	doc.parallels = append(doc.parallels, self.parallelRank)
+	if len(group) > 0 {
+		for _, last := range self.last {
+			last.Type = "none"
+		}
+		self.last = group
 	}
 	return self
 }
 
 func (self *Flow) AddNote(note string) *Flow {
-	key := fmt.Sprintf("Info%d", len(self.start.Doc.arrows)-1)
+	key := fmt.Sprintf("Info%d", self.start.Doc.ranks-1)
 	self.start.Doc.endPoints[key] = true
 	self.start.Doc.notes[key] = note
 	return self
@@ -110,7 +158,7 @@ digraph %s {
 		fmt.Fprintf(b, "\n\n\t%v [color=black, shape=box, label=\"%v\"];\n",
 			service.Label, service.Label)
 		last := service.Label
-		for i := 0; i < len(self.arrows); i++ {
+		for i := 0; i < self.ranks; i++ {
 			key := fmt.Sprintf("%v_%v", service.Label, i)
 			if self.endPoints[key] {
 				fmt.Fprintf(b, "\t%v -> %v;\n", last, key)
@@ -127,8 +175,20 @@ digraph %s {
 	}
 	fmt.Fprint(b, "}\n")
 
+	// Shade parallel arrows
+	for _, rank := range self.parallels {
+		fmt.Fprintf(b, "\tsubgraph cluster_parallel_%d { style=filled; color=\"#f4f4f4\"; ", rank)
+		for _, service := range self.services {
+			key := fmt.Sprintf("%v_%v", service.Label, rank)
+			if self.endPoints[key] {
+				fmt.Fprintf(b, "%v;\t", key)
+			}
+		}
+		fmt.Fprint(b, "}\n")
+	}
+
 	// Rank content
-	for i := 0; i < len(self.arrows); i++ {
+	for i := 0; i < self.ranks; i++ {
 		fmt.Fprint(b, "\t{ rank = same; ")
 		for _, service := range self.services {
 			key := fmt.Sprintf("%v_%v", service.Label, i)
@@ -152,8 +212,8 @@ digraph %s {
 	// Print arrows
 	fmt.Fprint(b, "\n\tedge [constraint=false, style=filled, fontsize=8, weight=0, arrowtail=none];\n")
 
-	for i, arrow := range self.arrows {
-		fmt.Fprintf(b, "\t%s_%d -> %s_%d [arrowhead=\"%s\" color=\"%s\", label=\"%s\"];\n", arrow.From.Label, i, arrow.To.Label, i, arrow.Type, arrow.Color, arrow.Label)
+	for _, arrow := range self.arrows {
+		fmt.Fprintf(b, "\t%s_%d -> %s_%d [arrowhead=\"%s\" color=\"%s\", label=\"%s\"];\n", arrow.From.Label, arrow.rank, arrow.To.Label, arrow.rank, arrow.Type, arrow.Color, arrow.Label)
 	}
 
 	for k, v := range self.notes {
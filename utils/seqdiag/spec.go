@@ -0,0 +1,105 @@
+package seqdiag
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/zond/sybutils/utils"
+)
+
+/*
+StepSpec describes one arrow in a flow, from the current service of the flow to To.
+
+If Parallel is set, To and Label are ignored and the steps in Parallel are added concurrently using Flow.Parallel.
+*/
+type StepSpec struct {
+	To       string     `json:"to,omitempty"`
+	Label    string     `json:"label,omitempty"`
+	Note     string     `json:"note,omitempty"`
+	Parallel []StepSpec `json:"parallel,omitempty"`
+}
+
+/*
+FlowSpec describes a flow starting at the service From.
+*/
+type FlowSpec struct {
+	From  string     `json:"from"`
+	Steps []StepSpec `json:"steps"`
+}
+
+/*
+DocSpec is a declarative description of a Doc, so that diagrams can be authored as data.
+
+Services are created in the order they are listed, and flows can only refer to listed services.
+*/
+type DocSpec struct {
+	Label    string     `json:"label"`
+	Services []string   `json:"services"`
+	Flows    []FlowSpec `json:"flows"`
+}
+
+/*
+Load will decode a JSON DocSpec from r and build a Doc from it.
+*/
+func Load(r io.Reader) (result *Doc, err error) {
+	spec := &DocSpec{}
+	if err = json.NewDecoder(r).Decode(spec); err != nil {
+		return
+	}
+	return spec.Doc()
+}
+
+/*
+Doc will build a Doc from the spec.
+*/
+func (self *DocSpec) Doc() (result *Doc, err error) {
+	result = NewDoc(self.Label)
+	services := map[string]*Service{}
+	for _, label := range self.Services {
+		if services[label] != nil {
+			err = utils.Errorf("Duplicate service %#v", label)
+			return
+		}
+		services[label] = result.NewService(label)
+	}
+	for index, flowSpec := range self.Flows {
+		from, found := services[flowSpec.From]
+		if !found {
+			err = utils.Errorf("Flow %v starts at unknown service %#v", index, flowSpec.From)
+			return
+		}
+		if len(flowSpec.Steps) == 0 {
+			err = utils.Errorf("Flow %v has no steps", index)
+			return
+		}
+		flow := from.newFlow()
+		if err = addSteps(flow, services, flowSpec.Steps); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func addSteps(flow *Flow, services map[string]*Service, steps []StepSpec) (err error) {
+	for _, step := range steps {
+		if len(step.Parallel) > 0 {
+			flow.Parallel(func(f *Flow) {
+				err = addSteps(f, services, step.Parallel)
+			})
+			if err != nil {
+				return
+			}
+		} else {
+			to, found := services[step.To]
+			if !found {
+				err = utils.Errorf("Step %#v goes to unknown service %#v", step.Label, step.To)
+				return
+			}
+			flow.Add(to, step.Label)
+		}
+		if step.Note != "" {
+			flow.AddNote(step.Note)
+		}
+	}
+	return
+}
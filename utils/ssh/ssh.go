@@ -1,15 +1,20 @@
 package ssh
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/soundtrackyourbrand/ssh"
+	"github.com/zond/sybutils/utils"
 	utilsRun "github.com/zond/sybutils/utils/run"
 )
 
@@ -83,11 +88,88 @@ func Rsync(user string, key []byte, addr, src, dst string, excludes ...string) (
 	return
 }
 
-func TarCopy(creds Creds, addr, src, dst string, excludes ...string) (err error) {
-	sess, err := New(creds, addr)
+/*
+KeepAlive is the TCP keepalive period of the connections opened by Dial.
+*/
+var KeepAlive = 30 * time.Second
+
+/*
+Client is one ssh connection to a host, reused by every operation run through it.
+
+It must be closed by the caller when no longer needed.
+*/
+type Client struct {
+	conn *ssh.ClientConn
+	Addr string
+}
+
+/*
+Dial will connect to addr using creds, returning a Client that can run several operations over the same connection.
+*/
+func Dial(creds Creds, addr string) (result *Client, err error) {
+	dialer := &net.Dialer{KeepAlive: KeepAlive}
+	netConn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	conn, err := ssh.Client(netConn, &ssh.ClientConfig{
+		User: creds.user,
+		Auth: []ssh.ClientAuth{
+			ssh.ClientAuthKeyring(creds),
+		},
+	})
+	if err != nil {
+		netConn.Close()
+		return
+	}
+	result = &Client{
+		conn: conn,
+		Addr: addr,
+	}
+	return
+}
+
+/*
+Close will close the connection of the client.
+*/
+func (self *Client) Close() error {
+	return self.conn.Close()
+}
+
+/*
+Session returns a new session on the connection of the client.
+*/
+func (self *Client) Session() (*ssh.Session, error) {
+	return self.conn.NewSession()
+}
+
+/*
+Run will run cmd on the host, with output going to os.Stdout and os.Stderr.
+*/
+func (self *Client) Run(cmd string) (err error) {
+	sess, err := self.Session()
 	if err != nil {
 		return
 	}
+	return self.runSession(sess, cmd)
+}
+
+func (self *Client) runSession(sess *ssh.Session, cmd string) error {
+	defer sess.Close()
+	sess.Stdout, sess.Stderr = os.Stdout, os.Stderr
+	utilsRun.Log.Infof(" *** ( %v ) %#v", self.Addr, cmd)
+	return sess.Run(cmd)
+}
+
+/*
+TarCopy will tar src locally and extract it in dst on the host.
+*/
+func (self *Client) TarCopy(src, dst string, excludes ...string) (err error) {
+	sess, err := self.Session()
+	if err != nil {
+		return
+	}
+	defer sess.Close()
 
 	params := []string{}
 	for _, exclude := range excludes {
@@ -100,71 +182,201 @@ func TarCopy(creds Creds, addr, src, dst string, excludes ...string) (err error)
 	sess.Stdin, sess.Stdout, sess.Stderr = pipein, os.Stdout, os.Stderr
 	tar.Stdin, tar.Stdout, tar.Stderr = os.Stdin, pipeout, os.Stderr
 
-	remoteDone := make(chan struct{})
+	remoteDone := make(chan error, 1)
 
 	go func() {
 		cmd := fmt.Sprintf("mkdir -p %#v && tar -x -v -z -C %#v", dst, dst)
-		fmt.Printf(" *** ( %v ) %#v\n", addr, cmd)
-		if err := sess.Run(cmd); err != nil {
-			panic(err)
-		}
-		close(remoteDone)
+		utilsRun.Log.Infof(" *** ( %v ) %#v", self.Addr, cmd)
+		remoteDone <- sess.Run(cmd)
 	}()
 
-	fmt.Printf(" ( *** %v ) %v", utilsRun.Host, "tar")
-	for _, bit := range params {
-		fmt.Printf(" %#v", bit)
-	}
-	fmt.Println("")
+	utilsRun.Echo(utilsRun.Host, "tar", params, "")
 	if err = tar.Run(); err != nil {
+		pipeout.CloseWithError(err)
 		return
 	}
 	if err = pipeout.Close(); err != nil {
 		return
 	}
 
-	<-remoteDone
+	return <-remoteDone
+}
+
+/*
+VerifiedTarCopy will TarCopy src to dst, and then verify that the sha256 sums of the extracted files
+match the ones of the source tree by running sha256sum on the host.
+*/
+func (self *Client) VerifiedTarCopy(src, dst string, excludes ...string) (err error) {
+	sums, err := checksums(src, excludes)
+	if err != nil {
+		return
+	}
+	if err = self.TarCopy(src, dst, excludes...); err != nil {
+		return
+	}
+	sess, err := self.Session()
+	if err != nil {
+		return
+	}
+	defer sess.Close()
+	sess.Stdin, sess.Stdout, sess.Stderr = bytes.NewReader(sums), os.Stdout, os.Stderr
+	cmd := fmt.Sprintf("cd %#v && sha256sum --quiet -c -", dst)
+	utilsRun.Log.Infof(" *** ( %v ) %#v", self.Addr, cmd)
+	if err = sess.Run(cmd); err != nil {
+		err = utils.Errorf("Verifying %#v at %v:%v failed: %v", src, self.Addr, dst, err)
+		return
+	}
+	return
+}
+
+func TarCopy(creds Creds, addr, src, dst string, excludes ...string) (err error) {
+	client, err := Dial(creds, addr)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	return client.TarCopy(src, dst, excludes...)
+}
+
+/*
+VerifiedTarCopy will TarCopy src to dst, and then verify that the sha256 sums of the extracted files
+match the ones of the source tree by running sha256sum remotely.
+*/
+func VerifiedTarCopy(creds Creds, addr, src, dst string, excludes ...string) (err error) {
+	client, err := Dial(creds, addr)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	return client.VerifiedTarCopy(src, dst, excludes...)
+}
+
+func excluded(path string, excludes []string) bool {
+	for _, exclude := range excludes {
+		if matched, _ := filepath.Match(exclude, filepath.Base(path)); matched {
+			return true
+		}
+		if matched, _ := filepath.Match(exclude, path); matched {
+			return true
+		}
+	}
+	return false
+}
 
+/*
+checksums returns the sha256 sums of all regular files under src in sha256sum format, with paths relative to the
+parent directory of src, like TarCopy extracts them.
+*/
+func checksums(src string, excludes []string) (result []byte, err error) {
+	buf := &bytes.Buffer{}
+	parent := filepath.Dir(src)
+	if err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(parent, path)
+		if err != nil {
+			return err
+		}
+		if excluded(rel, excludes) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		h := sha256.New()
+		if _, err = io.Copy(h, f); err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "%x  %v\n", h.Sum(nil), rel)
+		return nil
+	}); err != nil {
+		return
+	}
+	result = buf.Bytes()
 	return
 }
 
 func Run(creds Creds, addr, cmd string) (err error) {
-	sess, err := New(creds, addr)
+	client, err := Dial(creds, addr)
 	if err != nil {
 		return
 	}
+	defer client.Close()
+	return client.Run(cmd)
+}
 
-	in, out := io.Pipe()
-	sess.Stdin, sess.Stdout, sess.Stderr = in, os.Stdout, os.Stderr
+/*
+MaxRetryBackoff is the longest RunWithRetry will sleep between attempts.
+*/
+var MaxRetryBackoff = time.Minute
 
-	remoteDone := make(chan struct{})
+/*
+RunWithRetry will Run cmd on addr, retrying up to attempts times with utils.Backoff starting at backoff
+when the connection can't be established: network errors while dialing, and connections closed during the
+handshake or before the session opened.
 
-	go func() {
-		fmt.Printf(" *** ( %v ) %#v\n", addr, cmd)
-		if err = sess.Run(cmd); err != nil {
+Everything else (authentication failures, host key mismatches, non zero exit status and sessions dropped
+while the command was running) is returned immediately, since retrying would either not help or run the
+command twice.
+*/
+func RunWithRetry(creds Creds, addr, cmd string, attempts int, backoff time.Duration) (err error) {
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			wait := utils.Backoff(backoff, MaxRetryBackoff, attempt-1)
+			utilsRun.Log.Infof(" *** ( %v ) %v, retrying in %v", addr, err, wait)
+			time.Sleep(wait)
+		}
+		var client *Client
+		if client, err = Dial(creds, addr); err != nil {
+			if isConnectionError(err) {
+				continue
+			}
 			return
 		}
-		close(remoteDone)
-	}()
-	if err = out.Close(); err != nil {
+		var sess *ssh.Session
+		if sess, err = client.Session(); err != nil {
+			client.Close()
+			if isConnectionError(err) {
+				continue
+			}
+			return
+		}
+		err = client.runSession(sess, cmd)
+		client.Close()
 		return
 	}
-	<-remoteDone
 	return
 }
 
-func New(creds Creds, addr string) (result *ssh.Session, err error) {
-	sshConn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
-		User: creds.user,
-		Auth: []ssh.ClientAuth{
-			ssh.ClientAuthKeyring(creds),
-		},
-	})
+/*
+isConnectionError returns whether err means the connection itself failed, as opposed to being refused by the host.
+*/
+func isConnectionError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, isNetError := err.(net.Error)
+	return isNetError
+}
 
+/*
+New returns a session on a new connection to addr. The connection is not closed with the session, so prefer Dial
+and Client.Session.
+*/
+func New(creds Creds, addr string) (result *ssh.Session, err error) {
+	client, err := Dial(creds, addr)
 	if err != nil {
 		return
 	}
-
-	result, err = sshConn.NewSession()
+	result, err = client.Session()
 	return
 }
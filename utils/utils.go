@@ -9,7 +9,9 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"math/big"
 	"math/rand"
 	"os"
@@ -24,11 +26,13 @@ import (
 	"sync/atomic"
 	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/kr/pretty"
 	"github.com/zond/sybutils/utils/json"
 
 	"net/http"
+	"net/url"
 
 	"github.com/zond/sybutils/utils/run"
 )
@@ -66,6 +70,66 @@ func Stack() string {
 	return string(buf[:generated])
 }
 
+/*
+StackFrame is one call in a stack parsed by ParseStack.
+*/
+type StackFrame struct {
+	File     string
+	Line     int
+	Function string
+	Package  string
+}
+
+func (self StackFrame) String() string {
+	return fmt.Sprintf("%v.%v\n\t%v:%v", self.Package, self.Function, self.File, self.Line)
+}
+
+/*
+ParseStack will parse a stack as produced by Stack (or runtime.Stack) into frames, most recent call first.
+
+Goroutine headers are skipped, and a truncated last frame is dropped.
+*/
+func ParseStack(s string) (result []StackFrame) {
+	lines := strings.Split(s, "\n")
+	for i := 0; i+1 < len(lines); i++ {
+		funcLine := strings.TrimPrefix(lines[i], "created by ")
+		if funcLine == "" || strings.HasPrefix(funcLine, "goroutine ") || strings.HasPrefix(funcLine, "\t") {
+			continue
+		}
+		fileLine := lines[i+1]
+		if !strings.HasPrefix(fileLine, "\t") {
+			continue
+		}
+		i++
+		frame := StackFrame{}
+		fileLine = strings.TrimPrefix(fileLine, "\t")
+		if space := strings.LastIndex(fileLine, " +0x"); space != -1 {
+			fileLine = fileLine[:space]
+		}
+		if colon := strings.LastIndex(fileLine, ":"); colon != -1 {
+			frame.File = fileLine[:colon]
+			frame.Line, _ = strconv.Atoi(fileLine[colon+1:])
+		} else {
+			frame.File = fileLine
+		}
+		if paren := strings.LastIndex(funcLine, "("); paren > 0 && strings.HasSuffix(funcLine, ")") {
+			funcLine = funcLine[:paren]
+		}
+		if space := strings.Index(funcLine, " in goroutine "); space != -1 {
+			funcLine = funcLine[:space]
+		}
+		pkgStart := strings.LastIndex(funcLine, "/") + 1
+		if dot := strings.Index(funcLine[pkgStart:], "."); dot != -1 {
+			frame.Package = funcLine[:pkgStart+dot]
+			frame.Function = funcLine[pkgStart+dot+1:]
+		} else {
+			frame.Function = funcLine
+		}
+		result = append(result, frame)
+	}
+	return
+}
+
 func CamelToSnake(s string) (string, error) {
 	resultSlice := []string{}
 	i := 0
@@ -91,6 +155,23 @@ func CamelToSnake(s string) (string, error) {
 	return strings.Join(resultSlice, "_"), nil
 }
 
+/*
+TruncateUTF8 returns the longest prefix of s no longer than maxBytes that doesn't split a multi byte rune.
+*/
+func TruncateUTF8(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	if maxBytes < 0 {
+		return ""
+	}
+	cut := maxBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut]
+}
+
 func RandomString(i int) string {
 	buf := new(bytes.Buffer)
 	for buf.Len() < i {
@@ -137,6 +218,193 @@ func ReflectCopy(source, destinationPointer interface{}) {
 	}
 }
 
+/*
+EnumValidator validates that strings are one of a set of allowed values.
+*/
+type EnumValidator struct {
+	Name   string
+	values []string
+}
+
+/*
+NewEnumValidator returns a validator for the enum name allowing values.
+*/
+func NewEnumValidator(name string, values ...string) *EnumValidator {
+	return &EnumValidator{
+		Name:   name,
+		values: values,
+	}
+}
+
+/*
+Values returns the allowed values.
+*/
+func (self *EnumValidator) Values() []string {
+	return append([]string{}, self.values...)
+}
+
+/*
+Validate returns an error if s is not one of the allowed values.
+*/
+func (self *EnumValidator) Validate(s string) error {
+	for _, value := range self.values {
+		if s == value {
+			return nil
+		}
+	}
+	return Errorf("%#v is not a valid %v, must be one of %+v", s, self.Name, self.values)
+}
+
+/*
+Marshal will JSON encode s if it is valid, so that types with an EnumValidator can refuse to encode invalid values.
+*/
+func (self *EnumValidator) Marshal(s string) (result []byte, err error) {
+	if err = self.Validate(s); err != nil {
+		return
+	}
+	return json.Marshal(s)
+}
+
+/*
+Change is the old and new value of a field changed between two structs.
+*/
+type Change struct {
+	Old interface{}
+	New interface{}
+}
+
+/*
+Diff will compare the exported fields of old and new, which must be structs (or pointers to structs) of the same type,
+and return the changed fields keyed by their JSON names.
+
+Fields of embedded structs are compared as if they were fields of the outer struct.
+*/
+func Diff(old, new interface{}) (result map[string]Change, err error) {
+	oldVal := reflect.Indirect(reflect.ValueOf(old))
+	newVal := reflect.Indirect(reflect.ValueOf(new))
+	if oldVal.Kind() != reflect.Struct || newVal.Kind() != reflect.Struct {
+		err = Errorf("%+v and %+v are not both structs or pointers to structs", old, new)
+		return
+	}
+	if oldVal.Type() != newVal.Type() {
+		err = Errorf("%v and %v are not the same type", oldVal.Type(), newVal.Type())
+		return
+	}
+	result = map[string]Change{}
+	diff(oldVal, newVal, result)
+	return
+}
+
+func diff(oldVal, newVal reflect.Value, result map[string]Change) {
+	typ := oldVal.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		oldField, newField := oldVal.Field(i), newVal.Field(i)
+		if field.Anonymous {
+			if field.Type.Kind() == reflect.Ptr && !oldField.IsNil() && !newField.IsNil() {
+				oldField, newField = oldField.Elem(), newField.Elem()
+			}
+			if oldField.Kind() == reflect.Struct {
+				diff(oldField, newField, result)
+				continue
+			}
+		}
+		name := field.Name
+		if jsonTag := field.Tag.Get("json"); jsonTag == "-" {
+			continue
+		} else if jsonName := strings.Split(jsonTag, ",")[0]; jsonName != "" {
+			name = jsonName
+		}
+		if !reflect.DeepEqual(oldField.Interface(), newField.Interface()) {
+			result[name] = Change{
+				Old: oldField.Interface(),
+				New: newField.Interface(),
+			}
+		}
+	}
+}
+
+/*
+Merge will copy the exported fields of patch that are not zero values into dst, which must be a pointer to a struct of the
+same type as patch (or what patch points to).
+
+Fields of embedded structs are merged field by field, so that a partial update doesn't clobber the fields it didn't contain.
+*/
+func Merge(dst, patch interface{}) (err error) {
+	dstVal := reflect.ValueOf(dst)
+	if dstVal.Kind() != reflect.Ptr || dstVal.Elem().Kind() != reflect.Struct {
+		err = Errorf("%+v is not a pointer to a struct", dst)
+		return
+	}
+	dstVal = dstVal.Elem()
+	patchVal := reflect.Indirect(reflect.ValueOf(patch))
+	if patchVal.Type() != dstVal.Type() {
+		err = Errorf("%v and %v are not the same type", dstVal.Type(), patchVal.Type())
+		return
+	}
+	merge(dstVal, patchVal)
+	return
+}
+
+func merge(dstVal, patchVal reflect.Value) {
+	typ := dstVal.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		dstField, patchField := dstVal.Field(i), patchVal.Field(i)
+		if patchField.IsZero() {
+			continue
+		}
+		if field.Anonymous {
+			if field.Type.Kind() == reflect.Struct {
+				merge(dstField, patchField)
+				continue
+			}
+			if field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct && !dstField.IsNil() {
+				merge(dstField.Elem(), patchField.Elem())
+				continue
+			}
+		}
+		dstField.Set(patchField)
+	}
+}
+
+/*
+Clock provides the current time, so that code depending on it can be tested deterministically.
+*/
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (self realClock) Now() time.Time {
+	return time.Now()
+}
+
+var clock Clock = realClock{}
+
+/*
+SetClock makes Now, and the token expiry in EncodeToken and ParseAccessToken, use c. It returns the previous Clock so that
+tests can restore it.
+*/
+func SetClock(c Clock) (previous Clock) {
+	previous, clock = clock, c
+	return
+}
+
+/*
+Now returns the current time according to the Clock set with SetClock, or the real time if none was set.
+*/
+func Now() time.Time {
+	return clock.Now()
+}
+
 type AccessToken interface {
 	Encode() ([]byte, error)
 	Scopes() []string
@@ -154,6 +422,9 @@ var accessTokenType reflect.Type
 func ParseAccessTokens(s []byte, token AccessToken) {
 	secret = s
 	accessTokenType = reflect.TypeOf(token)
+	verifiedTokensLock.Lock()
+	verifiedTokens = map[string]verifiedToken{}
+	verifiedTokensLock.Unlock()
 	if accessTokenType.Kind() != reflect.Ptr || accessTokenType.Elem().Kind() != reflect.Struct {
 		panic(Errorf("%v is not a pointer to a struct", token))
 	}
@@ -162,7 +433,7 @@ func ParseAccessTokens(s []byte, token AccessToken) {
 
 func EncodeToken(token AccessToken, timeout time.Duration) (result string, err error) {
 	envelope := &tokenEnvelope{
-		ExpiresAt: time.Now().Add(timeout),
+		ExpiresAt: Now().Add(timeout),
 		Token:     token,
 	}
 	h, err := envelope.generateHash()
@@ -207,13 +478,114 @@ func ParseAccessToken(d string, dst AccessToken) (result AccessToken, err error)
 		dst = reflect.New(accessTokenType.Elem()).Interface().(AccessToken)
 	}
 	result = dst
-	envelope := &tokenEnvelope{}
+	envelope, err := verifyToken(d)
+	if err != nil {
+		return
+	}
+	err = envelope.copyTo(dst)
+	return
+}
+
+/*
+VerifiedTokenCacheTTL is how long ParseAccessTokenBatch remembers tokens it has verified, so that tokens repeated across
+batches aren't verified again. Zero disables the cache, and only tokens repeated within the same batch are deduplicated.
+*/
+var VerifiedTokenCacheTTL = time.Duration(0)
+
+/*
+MaxVerifiedTokens is how many verified tokens are cached before expired ones are swept from the cache. If it is still
+full after the sweep, the cache is dropped.
+*/
+var MaxVerifiedTokens = 10000
+
+type verifiedToken struct {
+	envelope   *tokenEnvelope
+	verifiedAt time.Time
+}
+
+var verifiedTokensLock sync.Mutex
+var verifiedTokens = map[string]verifiedToken{}
+
+func cachedToken(d string, now time.Time) (result *tokenEnvelope) {
+	verifiedTokensLock.Lock()
+	defer verifiedTokensLock.Unlock()
+	if verified, found := verifiedTokens[d]; found {
+		if now.Sub(verified.verifiedAt) >= VerifiedTokenCacheTTL {
+			delete(verifiedTokens, d)
+		} else {
+			result = verified.envelope
+		}
+	}
+	return
+}
+
+func cacheToken(d string, envelope *tokenEnvelope, now time.Time) {
+	verifiedTokensLock.Lock()
+	defer verifiedTokensLock.Unlock()
+	if len(verifiedTokens) >= MaxVerifiedTokens {
+		for encoded, verified := range verifiedTokens {
+			if now.Sub(verified.verifiedAt) >= VerifiedTokenCacheTTL {
+				delete(verifiedTokens, encoded)
+			}
+		}
+		if len(verifiedTokens) >= MaxVerifiedTokens {
+			verifiedTokens = map[string]verifiedToken{}
+		}
+	}
+	verifiedTokens[d] = verifiedToken{
+		envelope:   envelope,
+		verifiedAt: now,
+	}
+}
+
+/*
+ParseAccessTokenBatch will return the AccessTokens encoded in ds, with the error for each token in errs at the same index.
+
+Each distinct token is decoded and verified only once per batch, and if VerifiedTokenCacheTTL is set, only once per
+VerifiedTokenCacheTTL. Cached tokens are still checked for expiry. (The name ParseAccessTokens is taken by the function
+that sets the secret and token type.)
+*/
+func ParseAccessTokenBatch(ds []string) (results []AccessToken, errs []error) {
+	results = make([]AccessToken, len(ds))
+	errs = make([]error, len(ds))
+	now := Now()
+	type verification struct {
+		envelope *tokenEnvelope
+		err      error
+	}
+	verifications := map[string]verification{}
+	for index, d := range ds {
+		v, found := verifications[d]
+		if !found {
+			if VerifiedTokenCacheTTL > 0 {
+				v.envelope = cachedToken(d, now)
+			}
+			if v.envelope == nil {
+				if v.envelope, v.err = verifyToken(d); v.err == nil && VerifiedTokenCacheTTL > 0 {
+					cacheToken(d, v.envelope, now)
+				}
+			} else if v.envelope.ExpiresAt.Before(now) {
+				v.err = Errorf("Expired AccessToken: %v", v.envelope)
+			}
+			verifications[d] = v
+		}
+		dst := reflect.New(accessTokenType.Elem()).Interface().(AccessToken)
+		results[index] = dst
+		if errs[index] = v.err; errs[index] == nil {
+			errs[index] = v.envelope.copyTo(dst)
+		}
+	}
+	return
+}
+
+func verifyToken(d string) (envelope *tokenEnvelope, err error) {
+	envelope = &tokenEnvelope{}
 	dec := gob.NewDecoder(base64.NewDecoder(base64.URLEncoding, bytes.NewBufferString(strings.Replace(d, ".", "=", -1))))
 	if err = dec.Decode(&envelope); err != nil {
 		err = Errorf("Invalid AccessToken: %v, %v", d, err)
 		return
 	}
-	if envelope.ExpiresAt.Before(time.Now()) {
+	if envelope.ExpiresAt.Before(Now()) {
 		err = Errorf("Expired AccessToken: %v", envelope)
 		return
 	}
@@ -225,8 +597,12 @@ func ParseAccessToken(d string, dst AccessToken) (result AccessToken, err error)
 		err = Errorf("Invalid AccessToken: hash of %+v should be %v but was %v", envelope.Token, hex.EncodeToString(envelope.Hash), hex.EncodeToString(wantedHash))
 		return
 	}
+	return
+}
+
+func (self *tokenEnvelope) copyTo(dst AccessToken) (err error) {
 	dstVal := reflect.ValueOf(dst)
-	tokenVal := reflect.ValueOf(envelope.Token)
+	tokenVal := reflect.ValueOf(self.Token)
 	if dstVal.Kind() != reflect.Ptr {
 		err = Errorf("%#v is not a pointer", dst)
 		return
@@ -239,10 +615,49 @@ func ParseAccessToken(d string, dst AccessToken) (result AccessToken, err error)
 		err = Errorf("Can't load a %v into a %v", tokenVal.Type(), dstVal.Type())
 		return
 	}
-	dstVal.Elem().Set(tokenVal.Elem())
+	// Round trip through gob instead of copying the struct, so that slices and maps in dst don't share memory with the
+	// envelope, which may be cached and copied to other tokens.
+	b := &bytes.Buffer{}
+	if err = gob.NewEncoder(b).Encode(self.Token); err != nil {
+		return
+	}
+	dstVal.Elem().Set(reflect.Zero(dstVal.Elem().Type()))
+	err = gob.NewDecoder(b).Decode(dst)
 	return
 }
 
+/*
+Logger is the leveled logging interface used by the packages in this repository that don't run inside App Engine,
+so that consumers can route their logs through whatever logger they prefer.
+*/
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+/*
+StdLogger is a Logger writing to the standard library log package, prefixing each message with its level.
+*/
+type StdLogger struct{}
+
+func (self StdLogger) Debugf(format string, args ...interface{}) {
+	log.Printf("DEBUG: "+format, args...)
+}
+
+func (self StdLogger) Infof(format string, args ...interface{}) {
+	log.Printf("INFO: "+format, args...)
+}
+
+func (self StdLogger) Warningf(format string, args ...interface{}) {
+	log.Printf("WARNING: "+format, args...)
+}
+
+func (self StdLogger) Errorf(format string, args ...interface{}) {
+	log.Printf("ERROR: "+format, args...)
+}
+
 type StackError interface {
 	GetStack() string
 	Error() string
@@ -342,6 +757,28 @@ func ValidateFuncInputs(f interface{}, ins ...[]reflect.Type) (errs []error) {
 	return
 }
 
+/*
+exampleFromTag returns the value of the `example` tag of field, used verbatim for string fields and JSON decoded for
+other fields. ok is false if there is no tag, or if it can't be decoded.
+*/
+func exampleFromTag(field reflect.StructField) (result reflect.Value, ok bool) {
+	tag := field.Tag.Get("example")
+	if tag == "" {
+		return
+	}
+	val := reflect.New(field.Type)
+	if field.Type.Kind() == reflect.String {
+		val.Elem().SetString(tag)
+	} else if err := json.Unmarshal([]byte(tag), val.Interface()); err != nil {
+		return
+	}
+	return val.Elem(), true
+}
+
+/*
+Example returns an example value of t, using placeholders for strings and numbers unless the struct fields have
+`example` tags.
+*/
 func Example(t reflect.Type) (result interface{}) {
 	return example(t, map[string]int{})
 }
@@ -357,6 +794,13 @@ func example(t reflect.Type, seen map[string]int) (result interface{}) {
 		}
 		val.Index(0).Set(reflect.ValueOf(example(t.Elem(), seen)))
 		result = val.Interface()
+	case reflect.Map:
+		val := reflect.MakeMap(t)
+		result = val.Interface()
+		if seen[t.Name()] > 2 {
+			return
+		}
+		val.SetMapIndex(reflect.ValueOf(example(t.Key(), seen)), reflect.ValueOf(example(t.Elem(), seen)))
 	case reflect.Ptr:
 		val := reflect.New(t.Elem())
 		result = val.Interface()
@@ -388,7 +832,11 @@ func example(t reflect.Type, seen map[string]int) (result interface{}) {
 			for i := 0; i < t.NumField(); i++ {
 				field := t.Field(i)
 				if field.PkgPath == "" {
-					val.Elem().Field(i).Set(reflect.ValueOf(example(field.Type, seen)))
+					if tagged, ok := exampleFromTag(field); ok {
+						val.Elem().Field(i).Set(tagged)
+					} else {
+						val.Elem().Field(i).Set(reflect.ValueOf(example(field.Type, seen)))
+					}
 				}
 			}
 		}
@@ -599,17 +1047,152 @@ func ConstantTimeEqualBytes(b1, b2 []byte) bool {
 	return len(b1) == len(b2) && subtle.ConstantTimeCompare(b1, b2) == 1
 }
 
-// For debugging use. Converts a http.Request to a curl string for copy'n'paste to terminal
+// MaxClonedBodySize is the maximum number of bytes CloneRequestBody will return.
+var MaxClonedBodySize = 64 * 1024
+
+// ErrBodyTruncated is returned by CloneRequestBody along with the first MaxClonedBodySize bytes of bodies that are larger.
+var ErrBodyTruncated = fmt.Errorf("request body truncated")
+
+/*
+CloneRequestBody will return the body of req without consuming it, or nil if there is no body.
+
+If req has a GetBody function, like requests created by http.NewRequest with in memory bodies, a fresh copy of the body is read,
+which makes it safe to call multiple times and concurrently. Otherwise the read bytes are put back in front of the rest of
+req.Body.
+
+At most MaxClonedBodySize bytes are read, and if the body is larger ErrBodyTruncated is returned along with them.
+*/
+func CloneRequestBody(req *http.Request) (result []byte, err error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	if req.GetBody != nil {
+		var body io.ReadCloser
+		if body, err = req.GetBody(); err != nil {
+			return
+		}
+		defer body.Close()
+		if result, err = ioutil.ReadAll(io.LimitReader(body, int64(MaxClonedBodySize)+1)); err != nil {
+			return
+		}
+	} else {
+		if result, err = ioutil.ReadAll(io.LimitReader(req.Body, int64(MaxClonedBodySize)+1)); err != nil {
+			return
+		}
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{
+			Reader: io.MultiReader(bytes.NewReader(result), req.Body),
+			Closer: req.Body,
+		}
+	}
+	if len(result) > MaxClonedBodySize {
+		result = result[:MaxClonedBodySize]
+		err = ErrBodyTruncated
+	}
+	return
+}
+
+var (
+	// RedactCurl makes ToCurl mask the RedactedHeaders and RedactedBodyFields. Only turn it off for local debugging.
+	RedactCurl = true
+	// RedactedHeaders are the headers whose values ToCurl masks.
+	RedactedHeaders = []string{"Authorization", "Cookie", "X-Sentry-Auth"}
+	// RedactedBodyFields are the (case insensitive) names of the JSON object keys and form fields whose values ToCurl masks.
+	RedactedBodyFields = []string{"password", "credentials"}
+)
+
+const redacted = "[redacted]"
+
+func isRedactedBodyField(name string) bool {
+	for _, field := range RedactedBodyFields {
+		if strings.EqualFold(field, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactJSON(i interface{}) interface{} {
+	switch v := i.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			if isRedactedBodyField(key) {
+				v[key] = redacted
+			} else {
+				v[key] = redactJSON(val)
+			}
+		}
+	case []interface{}:
+		for index, val := range v {
+			v[index] = redactJSON(val)
+		}
+	}
+	return i
+}
+
+/*
+redactBody will return b with the values of RedactedBodyFields masked, if it is a JSON or form encoded body.
+*/
+func redactBody(req *http.Request, b []byte) []byte {
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if values, err := url.ParseQuery(string(b)); err == nil {
+			for key := range values {
+				if isRedactedBodyField(key) {
+					values.Set(key, redacted)
+				}
+			}
+			return []byte(values.Encode())
+		}
+		return b
+	}
+	var i interface{}
+	if err := json.Unmarshal(b, &i); err != nil {
+		return b
+	}
+	if redactedJSON, err := json.Marshal(redactJSON(i)); err == nil {
+		return redactedJSON
+	}
+	return b
+}
+
+/*
+ToCurl converts req to a curl command for copy'n'paste to a terminal, for debugging use.
+
+Unless RedactCurl is false, the RedactedHeaders and RedactedBodyFields are masked, and truncated bodies (that can't be
+parsed to find the fields to mask) are left out.
+*/
 func ToCurl(req *http.Request) string {
 	bodyPart := ""
-	if req.Body != nil {
-		b, _ := ioutil.ReadAll(req.Body)
-		req.Body = ioutil.NopCloser(bytes.NewBuffer(b))
+	if b, err := CloneRequestBody(req); err == ErrBodyTruncated {
+		if RedactCurl {
+			bodyPart = fmt.Sprintf(" [body larger than %v bytes redacted]", len(b))
+		} else {
+			bodyPart = fmt.Sprintf(" -d %#v [truncated to %v bytes]", string(b), len(b))
+		}
+	} else if err != nil {
+		bodyPart = fmt.Sprintf(" [unable to read body: %v]", err)
+	} else if b != nil {
+		if RedactCurl {
+			b = redactBody(req, b)
+		}
 		bodyPart = fmt.Sprintf(" -d %#v", string(b))
 	}
 	headers := []string{}
 	for header, vals := range req.Header {
+		redactHeader := false
+		if RedactCurl {
+			for _, redactedHeader := range RedactedHeaders {
+				if strings.EqualFold(redactedHeader, header) {
+					redactHeader = true
+				}
+			}
+		}
 		for _, val := range vals {
+			if redactHeader {
+				val = redacted
+			}
 			headers = append(headers, fmt.Sprintf("-H \"%s: %s\"", header, val))
 		}
 	}
@@ -729,16 +1312,65 @@ func ParseFlags(i interface{}, defaultMap map[string]string) (err error) {
 	return
 }
 
-type MultiError []error
+/*
+Pagination limits the page sizes list handlers return.
+*/
+type Pagination struct {
+	// DefaultLimit is used when no limit is requested.
+	DefaultLimit int
+	// MaxLimit is the largest limit allowed.
+	MaxLimit int
+}
+
+// DefaultPagination is the Pagination used by NormalizePagination.
+var DefaultPagination = Pagination{
+	DefaultLimit: 20,
+	MaxLimit:     100,
+}
 
-func (self MultiError) Error() string {
-	s := make([]string, len(self))
-	for index, err := range self {
-		s[index] = err.Error()
+/*
+Normalize returns offset and limit clamped to valid values, using DefaultLimit for non positive limits and never returning more than MaxLimit.
+*/
+func (self Pagination) Normalize(offset, limit int) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = self.DefaultLimit
+	}
+	if limit > self.MaxLimit {
+		limit = self.MaxLimit
+	}
+	return offset, limit
+}
+
+/*
+NormalizePagination normalizes offset and limit using DefaultPagination.
+*/
+func NormalizePagination(offset, limit int) (int, int) {
+	return DefaultPagination.Normalize(offset, limit)
+}
+
+/*
+Backoff returns a randomly jittered duration to sleep before retry number attempt (starting at 0),
+growing exponentially from base and never exceeding max.
+*/
+func Backoff(base, max time.Duration, attempt int) time.Duration {
+	d := max
+	if attempt < 32 {
+		if shifted := base << uint(attempt); shifted > 0 && shifted < max {
+			d = shifted
+		}
 	}
-	return strings.Join(s, ", ")
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
 }
 
+// MultiError lives in run, which can't import utils.
+type MultiError = run.MultiError
+
 type Parallelizer struct {
 	count int64
 	c     chan error
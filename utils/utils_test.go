@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"math/big"
 	"math/rand"
+	"net/http"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -66,3 +70,311 @@ func TestEncodeBytes(t *testing.T) {
 		}
 	}
 }
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		d := Backoff(time.Millisecond, time.Second, attempt)
+		if d <= 0 || d > time.Second {
+			t.Fatalf("Backoff for attempt %v should be in (0, 1s], but was %v", attempt, d)
+		}
+		if attempt < 3 && d > time.Millisecond<<uint(attempt) {
+			t.Fatalf("Backoff for attempt %v should be at most %v, but was %v", attempt, time.Millisecond<<uint(attempt), d)
+		}
+	}
+}
+
+func TestParseStack(t *testing.T) {
+	stack := `goroutine 1 [running]:
+github.com/zond/sybutils/utils.Stack()
+	/go/src/github.com/zond/sybutils/utils/utils.go:61 +0x5d
+github.com/zond/sybutils/utils.(*SyncLock).Sync(0xc000010000, {0x0, 0x0})
+	/go/src/github.com/zond/sybutils/utils/utils.go:700 +0x1d
+main.main()
+	/go/src/main.go:12 +0x25
+created by testing.(*T).Run in goroutine 1
+	/usr/lib/go/src/testing/testing.go:1742 +0x390
+github.com/zond/sybutils/utils.trunc`
+	frames := ParseStack(stack)
+	wanted := []StackFrame{
+		{File: "/go/src/github.com/zond/sybutils/utils/utils.go", Line: 61, Function: "Stack", Package: "github.com/zond/sybutils/utils"},
+		{File: "/go/src/github.com/zond/sybutils/utils/utils.go", Line: 700, Function: "(*SyncLock).Sync", Package: "github.com/zond/sybutils/utils"},
+		{File: "/go/src/main.go", Line: 12, Function: "main", Package: "main"},
+		{File: "/usr/lib/go/src/testing/testing.go", Line: 1742, Function: "(*T).Run", Package: "testing"},
+	}
+	if !reflect.DeepEqual(frames, wanted) {
+		t.Fatalf("Wanted %+v but got %+v", wanted, frames)
+	}
+	if frames := ParseStack(Stack()); len(frames) == 0 || frames[0].Function != "Stack" {
+		t.Fatalf("Parsing a real stack should start with Stack, but got %+v", frames)
+	}
+}
+
+type exampleCountry string
+
+type exampleTagged struct {
+	Country exampleCountry `example:"SE"`
+	Age     int            `example:"42"`
+	Tags    []string       `example:"[\"a\",\"b\"]"`
+	Broken  int            `example:"x"`
+	Name    string
+}
+
+func TestExampleTags(t *testing.T) {
+	result := Example(reflect.TypeOf(exampleTagged{})).(exampleTagged)
+	wanted := exampleTagged{
+		Country: "SE",
+		Age:     42,
+		Tags:    []string{"a", "b"},
+		Broken:  1,
+		Name:    "[...]",
+	}
+	if !reflect.DeepEqual(result, wanted) {
+		t.Errorf("Wanted %+v, got %+v", wanted, result)
+	}
+}
+
+type DiffMeta struct {
+	CreatedBy string `json:"created_by"`
+}
+
+type diffModel struct {
+	DiffMeta
+	Name    string `json:"name"`
+	Comment string
+	Ignored int `json:"-"`
+	Tags    []string
+}
+
+func TestDiff(t *testing.T) {
+	old := &diffModel{
+		DiffMeta: DiffMeta{CreatedBy: "a"},
+		Name:     "x",
+		Comment:  "c",
+		Ignored:  1,
+		Tags:     []string{"t"},
+	}
+	new := &diffModel{
+		DiffMeta: DiffMeta{CreatedBy: "b"},
+		Name:     "x",
+		Comment:  "d",
+		Ignored:  2,
+		Tags:     []string{"t"},
+	}
+	changes, err := Diff(old, new)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wanted := map[string]Change{
+		"created_by": {Old: "a", New: "b"},
+		"Comment":    {Old: "c", New: "d"},
+	}
+	if !reflect.DeepEqual(changes, wanted) {
+		t.Errorf("Wanted %+v, got %+v", wanted, changes)
+	}
+	if _, err = Diff(old, DiffMeta{}); err == nil {
+		t.Errorf("Wanted an error diffing different types")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dst := &diffModel{
+		DiffMeta: DiffMeta{CreatedBy: "a"},
+		Name:     "x",
+		Comment:  "c",
+	}
+	if err := Merge(dst, diffModel{Name: "y"}); err != nil {
+		t.Fatal(err)
+	}
+	wanted := &diffModel{
+		DiffMeta: DiffMeta{CreatedBy: "a"},
+		Name:     "y",
+		Comment:  "c",
+	}
+	if !reflect.DeepEqual(dst, wanted) {
+		t.Errorf("Wanted %+v, got %+v", wanted, dst)
+	}
+	if err := Merge(*dst, diffModel{}); err == nil {
+		t.Errorf("Wanted an error merging into a non pointer")
+	}
+}
+
+func TestEnumValidator(t *testing.T) {
+	validator := NewEnumValidator("Color", "red", "blue")
+	if err := validator.Validate("red"); err != nil {
+		t.Errorf("Wanted red to be valid, got %v", err)
+	}
+	if err := validator.Validate("green"); err == nil {
+		t.Errorf("Wanted green to be invalid")
+	}
+	if b, err := validator.Marshal("blue"); err != nil || string(b) != `"blue"` {
+		t.Errorf("Wanted \"blue\", got %s, %v", b, err)
+	}
+	if _, err := validator.Marshal("green"); err == nil {
+		t.Errorf("Wanted an error marshalling green")
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	for _, c := range []struct {
+		s        string
+		maxBytes int
+		wanted   string
+	}{
+		{"abc", 5, "abc"},
+		{"abc", 2, "ab"},
+		{"aåb", 2, "a"},
+		{"aåb", 3, "aå"},
+		{"€", 2, ""},
+		{"abc", 0, ""},
+	} {
+		if result := TruncateUTF8(c.s, c.maxBytes); result != c.wanted {
+			t.Errorf("TruncateUTF8(%q, %v) should be %q, got %q", c.s, c.maxBytes, c.wanted, result)
+		}
+	}
+}
+
+func TestNormalizeLocale(t *testing.T) {
+	for _, c := range []struct {
+		s      string
+		wanted string
+	}{
+		{"EN", "en"},
+		{"sv_SE ", "sv_SE"},
+		{"sv-se", "sv_SE"},
+		{"sweden", ""},
+		{"sv_XX", ""},
+		{"sv_SE_x", ""},
+	} {
+		result, err := NormalizeLocale(c.s)
+		if c.wanted == "" {
+			if err == nil {
+				t.Errorf("NormalizeLocale(%q) should fail, got %q", c.s, result)
+			}
+		} else if err != nil || result != c.wanted {
+			t.Errorf("NormalizeLocale(%q) should be %q, got %q, %v", c.s, c.wanted, result, err)
+		}
+	}
+	if result, err := NormalizeISOCountry(" se"); err != nil || result != "SE" {
+		t.Errorf("Wanted SE, got %q, %v", result, err)
+	}
+	if _, err := NormalizeISOCountry("sweden"); err == nil {
+		t.Errorf("Wanted sweden to be invalid")
+	}
+}
+
+type fixedClock time.Time
+
+func (self fixedClock) Now() time.Time {
+	return time.Time(self)
+}
+
+type testToken struct {
+	Name string
+	Tags []string
+}
+
+func (self *testToken) Encode() ([]byte, error) {
+	return []byte(self.Name), nil
+}
+
+func (self *testToken) Scopes() []string {
+	return nil
+}
+
+func TestTokenExpiry(t *testing.T) {
+	ParseAccessTokens([]byte("secret"), &testToken{})
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer SetClock(SetClock(fixedClock(start)))
+	encoded, err := EncodeToken(&testToken{Name: "a"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetClock(fixedClock(start.Add(time.Minute - time.Nanosecond)))
+	if token, err := ParseAccessToken(encoded, nil); err != nil || token.(*testToken).Name != "a" {
+		t.Errorf("Wanted a valid token named a, got %+v, %v", token, err)
+	}
+	SetClock(fixedClock(start.Add(time.Minute + time.Nanosecond)))
+	if _, err := ParseAccessToken(encoded, nil); err == nil {
+		t.Errorf("Wanted an expired token")
+	}
+}
+
+func TestToCurlRedaction(t *testing.T) {
+	req, err := http.NewRequest("POST", "http://localhost/login", strings.NewReader(`{"user":{"email":"a@b.c","Password":"hunter2"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+	curl := ToCurl(req)
+	if strings.Contains(curl, "hunter2") || strings.Contains(curl, "secret") {
+		t.Errorf("Wanted password and token to be redacted, got %v", curl)
+	}
+	if !strings.Contains(curl, "a@b.c") {
+		t.Errorf("Wanted email to be kept, got %v", curl)
+	}
+	RedactCurl = false
+	defer func() {
+		RedactCurl = true
+	}()
+	if curl = ToCurl(req); !strings.Contains(curl, "hunter2") || !strings.Contains(curl, "secret") {
+		t.Errorf("Wanted password and token to be kept, got %v", curl)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	pagination := Pagination{DefaultLimit: 10, MaxLimit: 50}
+	for _, c := range []struct {
+		offset, limit             int
+		wantedOffset, wantedLimit int
+	}{
+		{0, 0, 0, 10},
+		{-5, -1, 0, 10},
+		{20, 30, 20, 30},
+		{0, 1000000, 0, 50},
+	} {
+		if offset, limit := pagination.Normalize(c.offset, c.limit); offset != c.wantedOffset || limit != c.wantedLimit {
+			t.Errorf("Normalize(%v, %v) should be %v, %v, got %v, %v", c.offset, c.limit, c.wantedOffset, c.wantedLimit, offset, limit)
+		}
+	}
+}
+
+func TestParseAccessTokenBatch(t *testing.T) {
+	ParseAccessTokens([]byte("secret"), &testToken{})
+	start := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer SetClock(SetClock(fixedClock(start)))
+	defer func(ttl time.Duration) { VerifiedTokenCacheTTL = ttl }(VerifiedTokenCacheTTL)
+	VerifiedTokenCacheTTL = time.Hour
+	a, err := EncodeToken(&testToken{Name: "a"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := EncodeToken(&testToken{Name: "b", Tags: []string{"tag"}}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, errs := ParseAccessTokenBatch([]string{a, "invalid", b, a})
+	for index, wanted := range []string{"a", "", "b", "a"} {
+		if wanted == "" {
+			if errs[index] == nil {
+				t.Errorf("Wanted an error for token %v", index)
+			}
+		} else if errs[index] != nil || results[index].(*testToken).Name != wanted {
+			t.Errorf("Wanted a valid token named %v at %v, got %+v, %v", wanted, index, results[index], errs[index])
+		}
+	}
+	if results[0] == results[3] {
+		t.Errorf("Wanted separate results for repeated tokens")
+	}
+	results[2].(*testToken).Tags[0] = "mutated"
+	SetClock(fixedClock(start.Add(2 * time.Minute)))
+	results, errs = ParseAccessTokenBatch([]string{a, b})
+	if errs[0] == nil {
+		t.Errorf("Wanted the cached token a to be expired")
+	}
+	if errs[1] != nil || results[1].(*testToken).Name != "b" {
+		t.Errorf("Wanted a valid token named b, got %+v, %v", results[1], errs[1])
+	}
+	if tags := results[1].(*testToken).Tags; len(tags) != 1 || tags[0] != "tag" {
+		t.Errorf("Wanted the cached token b to be unaffected by changes to earlier results, got %+v", tags)
+	}
+}
@@ -0,0 +1,83 @@
+package httpcontext
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+/*
+MaxDecompressedBodySize is the largest number of bytes a compressed request body is allowed to decompress into,
+to protect against zip bombs.
+*/
+var MaxDecompressedBodySize int64 = 32 << 20
+
+/*
+decompressingBody decompresses a gzip or deflate request body, initializing the decompressor on the first read.
+*/
+type decompressingBody struct {
+	raw       io.ReadCloser
+	encoding  string
+	reader    io.Reader
+	remaining int64
+}
+
+func (self *decompressingBody) Read(b []byte) (n int, err error) {
+	if self.reader == nil {
+		switch self.encoding {
+		case "gzip":
+			if self.reader, err = gzip.NewReader(self.raw); err != nil {
+				err = NewError(400, "Bad Request", fmt.Sprintf("Unable to decompress gzip body: %v", err), err)
+				return
+			}
+		case "deflate":
+			if self.reader, err = zlib.NewReader(self.raw); err != nil {
+				err = NewError(400, "Bad Request", fmt.Sprintf("Unable to decompress deflate body: %v", err), err)
+				return
+			}
+		}
+	}
+	if self.remaining <= 0 {
+		// Check if there is anything left before complaining.
+		if n, err = self.reader.Read(make([]byte, 1)); n > 0 {
+			n, err = 0, NewError(413, "Request Entity Too Large", fmt.Sprintf("Decompressed body larger than %v bytes", MaxDecompressedBodySize), nil)
+		}
+		return
+	}
+	if int64(len(b)) > self.remaining {
+		b = b[:self.remaining]
+	}
+	n, err = self.reader.Read(b)
+	self.remaining -= int64(n)
+	return
+}
+
+func (self *decompressingBody) Close() error {
+	if closer, ok := self.reader.(io.Closer); ok {
+		closer.Close()
+	}
+	return self.raw.Close()
+}
+
+/*
+decompressBody will replace the body of r with a decompressing one if its Content-Encoding is gzip or deflate.
+*/
+func decompressBody(r *http.Request) {
+	if r == nil || r.Body == nil {
+		return
+	}
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	if encoding != "gzip" && encoding != "deflate" {
+		return
+	}
+	r.Body = &decompressingBody{
+		raw:       r.Body,
+		encoding:  encoding,
+		remaining: MaxDecompressedBodySize,
+	}
+	r.Header.Del("Content-Encoding")
+	r.ContentLength = -1
+}
@@ -1,12 +1,16 @@
 package httpcontext
 
 import (
+	"bufio"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -25,6 +29,9 @@ var prefPattern = regexp.MustCompile("^([^\\s;]+)(;q=([\\d.]+))?$")
 
 var ErrorStackTraces = false
 
+// Log is where Handle logs errors returned by handlers.
+var Log utils.Logger = utils.StdLogger{}
+
 type Statuserr interface {
 	error
 	GetStatus() int
@@ -105,6 +112,13 @@ func (self *DefaultMemorableResponseWriter) Status() int {
 	return self.status
 }
 
+/*
+HeaderWritten returns whether the status and headers have already been sent.
+*/
+func (self *DefaultMemorableResponseWriter) HeaderWritten() bool {
+	return self.status != 0
+}
+
 func (self *DefaultMemorableResponseWriter) Header() http.Header {
 	return self.ResponseWriter.Header()
 }
@@ -121,6 +135,40 @@ func (self *DefaultMemorableResponseWriter) WriteHeader(status int) {
 	self.ResponseWriter.WriteHeader(status)
 }
 
+/*
+Flush will send any buffered data to the client, if the wrapped ResponseWriter is an http.Flusher.
+*/
+func (self *DefaultMemorableResponseWriter) Flush() {
+	if flusher, ok := self.ResponseWriter.(http.Flusher); ok {
+		if self.status == 0 {
+			self.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+/*
+Hijack will let the caller take over the connection, if the wrapped ResponseWriter is an http.Hijacker.
+*/
+func (self *DefaultMemorableResponseWriter) Hijack() (conn net.Conn, rw *bufio.ReadWriter, err error) {
+	hijacker, ok := self.ResponseWriter.(http.Hijacker)
+	if !ok {
+		err = utils.Errorf("%T is not an http.Hijacker", self.ResponseWriter)
+		return
+	}
+	if conn, rw, err = hijacker.Hijack(); err == nil && self.status == 0 {
+		self.status = http.StatusSwitchingProtocols
+	}
+	return
+}
+
+/*
+Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+*/
+func (self *DefaultMemorableResponseWriter) Unwrap() http.ResponseWriter {
+	return self.ResponseWriter
+}
+
 type HTTPContext interface {
 	Vars() map[string]string
 	Req() *http.Request
@@ -134,9 +182,18 @@ type DefaultHTTPContext struct {
 	response MemorableResponseWriter
 	request  *http.Request
 	vars     map[string]string
+
+	tokenLock   sync.Mutex
+	tokenParsed bool
+	token       utils.AccessToken
+	tokenErr    error
 }
 
+/*
+NewHTTPContext returns a context for w and r, transparently decompressing gzip or deflate encoded request bodies.
+*/
 func NewHTTPContext(w http.ResponseWriter, r *http.Request) (result *DefaultHTTPContext) {
+	decompressBody(r)
 	result = &DefaultHTTPContext{
 		response: &DefaultMemorableResponseWriter{
 			ResponseWriter: w,
@@ -167,7 +224,86 @@ func MostAccepted(r *http.Request, name, def string) string {
 	return bestValue
 }
 
+type languageRange struct {
+	tag   string
+	score float64
+}
+
+type languageRangesByScore []languageRange
+
+func (self languageRangesByScore) Len() int           { return len(self) }
+func (self languageRangesByScore) Less(i, j int) bool { return self[i].score > self[j].score }
+func (self languageRangesByScore) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+/*
+NegotiateLocale will return the supported locale best matching the Accept-Language header of r, or def if none match.
+
+Language ranges are tried in order of their q-values, and ranges not supported will fall back to less specific
+ones, so that "en-US" matches a supported "en".
+*/
+func NegotiateLocale(r *http.Request, supported []string, def string) string {
+	ranges := languageRangesByScore{}
+	for _, pref := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		if match := prefPattern.FindStringSubmatch(strings.TrimSpace(pref)); match != nil {
+			score := 1.0
+			if match[3] != "" {
+				score, _ = strconv.ParseFloat(match[3], 64)
+			}
+			if score > 0 {
+				ranges = append(ranges, languageRange{tag: match[1], score: score})
+			}
+		}
+	}
+	sort.Stable(ranges)
+	for _, lang := range ranges {
+		if lang.tag == "*" {
+			return def
+		}
+		for tag := lang.tag; tag != ""; {
+			for _, locale := range supported {
+				if strings.EqualFold(locale, tag) {
+					return locale
+				}
+			}
+			if index := strings.LastIndex(tag, "-"); index != -1 {
+				tag = tag[:index]
+			} else {
+				tag = ""
+			}
+		}
+	}
+	return def
+}
+
+func (self *DefaultHTTPContext) NegotiateLocale(supported []string, def string) string {
+	return NegotiateLocale(self.Req(), supported, def)
+}
+
+/*
+AccessToken returns the token of the request, parsed from the Authorization header, the token query parameter or the token cookie.
+
+The token is only parsed once per context, into dst if the first call provides one. Calls with a nil dst all return the
+parsed token, and calls with a dst of the same type get a copy of it.
+*/
 func (self *DefaultHTTPContext) AccessToken(dst utils.AccessToken) (result utils.AccessToken, err error) {
+	self.tokenLock.Lock()
+	defer self.tokenLock.Unlock()
+	if !self.tokenParsed {
+		self.token, self.tokenErr = self.parseAccessToken(dst)
+		self.tokenParsed = true
+		return self.token, self.tokenErr
+	}
+	if self.tokenErr != nil || dst == nil {
+		return self.token, self.tokenErr
+	}
+	if dstVal, tokenVal := reflect.ValueOf(dst), reflect.ValueOf(self.token); dstVal.Type() == tokenVal.Type() && dstVal.Kind() == reflect.Ptr && !dstVal.IsNil() {
+		dstVal.Elem().Set(tokenVal.Elem())
+		return dst, nil
+	}
+	return self.parseAccessToken(dst)
+}
+
+func (self *DefaultHTTPContext) parseAccessToken(dst utils.AccessToken) (result utils.AccessToken, err error) {
 	if self.Req() == nil {
 		err = ErrMissingToken
 		return
@@ -227,6 +363,9 @@ func (self *DefaultHTTPContext) CheckScopes(allowedScopes []string) (err error)
 }
 
 func Handle(c HTTPContext, f func() error, scopes ...string) {
+	defer func() {
+		recoverPanic(c.Resp(), c.Req(), recover())
+	}()
 	err := c.CheckScopes(scopes)
 	if err == nil {
 		err = f()
@@ -242,12 +381,16 @@ func Handle(c HTTPContext, f func() error, scopes ...string) {
 			fmt.Fprintf(c.Resp(), "%v", err)
 		}
 		if c.Resp().Status() >= 500 {
-			log.Printf("%v\n%v\n\n", c.Req().URL, err)
+			Log.Errorf("%v\n%v\n\n", c.Req().URL, err)
 		} else {
-			log.Printf("%v\n%v\n\n", c.Req().URL, err)
+			Log.Warningf("%v\n%v\n\n", c.Req().URL, err)
 		}
 		if stacker, ok := err.(utils.StackError); ok {
-			log.Printf("%s", string(stacker.GetStack()))
+			frames := []string{}
+			for _, frame := range utils.ParseStack(stacker.GetStack()) {
+				frames = append(frames, frame.String())
+			}
+			Log.Debugf("%s", strings.Join(frames, "\n"))
 		}
 	}
 }
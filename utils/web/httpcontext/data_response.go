@@ -87,6 +87,7 @@ func (self DataResp) Render(c HTTPContext) error {
 			fmt.Fprintf(c.Resp(), "</tr>")
 		}
 		fmt.Fprintf(c.Resp(), "</tbody></body></html>")
+		return nil
 	case ContentJSON:
 		// I dont know a way of creating json, and streaming it to the user.
 		var resp []map[string]interface{}
@@ -110,37 +111,56 @@ func (self DataResp) Render(c HTTPContext) error {
 				return err
 			}
 		}
+		return nil
 	}
 	return fmt.Errorf("Unknown content type %#v", self.ContentType)
 }
 
 var suffixPattern = regexp.MustCompile("\\.(\\w{1,6})$")
 
+// acceptedSuffixes maps Accept header media types to the suffixes DataContentType negotiates them to.
+var acceptedSuffixes = map[string]string{
+	"application/vnd.ms-excel":  "csv",
+	"text/html":                 "html",
+	"application/x-json-stream": "jjson",
+}
+
+/*
+DataContentType returns the content type to render tabular data as, depending on the suffix of the request path.
+
+If negotiate is true and the path has no suffix, the Accept header of the request is consulted instead. Without a suffix or a
+negotiated type, ContentJSON is returned.
+*/
+func DataContentType(c HTTPContext, negotiate bool) string {
+	match := suffixPattern.FindStringSubmatch(c.Req().URL.Path)
+	suffix := ""
+	if match != nil {
+		suffix = match[1]
+	} else if negotiate {
+		suffix = acceptedSuffixes[c.MostAccepted("Accept", "application/json")]
+	}
+	switch suffix {
+	case "csv":
+		return ContentExcelCSV
+	case "html":
+		return ContentHTML
+	case "jjson":
+		return ContentJSONStream
+	}
+	return ContentJSON
+}
+
+/*
+DataHandle will render the response of f as CSV, HTML, streamed JSON or JSON depending on the suffix of the request path.
+*/
 func DataHandle(c HTTPContext, f func() (*DataResp, error), scopes ...string) {
 	Handle(c, func() (err error) {
 		resp, err := f()
 		if err != nil {
 			return
 		}
-		match := suffixPattern.FindStringSubmatch(c.Req().URL.Path)
-		suffix := ""
-		if match != nil {
-			suffix = match[1]
-		}
-		switch suffix {
-		case "csv":
-			resp.ContentType = ContentExcelCSV
-		case "html":
-			resp.ContentType = ContentHTML
-		case "jjson":
-			resp.ContentType = ContentJSONStream
-		default:
-			resp.ContentType = ContentJSON
-		}
-		if err == nil {
-			err = resp.Render(c)
-		}
-		return
+		resp.ContentType = DataContentType(c, false)
+		return resp.Render(c)
 	}, scopes...)
 }
 
@@ -0,0 +1,75 @@
+package httpcontext
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zond/sybutils/utils"
+)
+
+// RequestIDHeader is the header used to identify requests in panic responses, generated if the request doesn't have one.
+const RequestIDHeader = "X-Request-Id"
+
+/*
+PanicReporter, if set, will be called with the request, its id and an error with the stack of each panic recovered by Handle or Recover,
+for example to send it to Sentry using sentry.NewPanicReporter.
+*/
+var PanicReporter func(r *http.Request, requestID string, err utils.StackError)
+
+/*
+headerWriter is implemented by response writers that know whether the status and headers have been sent, like
+DefaultMemorableResponseWriter.
+*/
+type headerWriter interface {
+	HeaderWritten() bool
+}
+
+/*
+recoverPanic will, if e is a recovered panic, log it with its stack, report it to PanicReporter, and respond with a 500 status
+and a message only containing the request id.
+
+If w has already sent its headers the response can't be replaced, so the panic is only logged and reported.
+*/
+func recoverPanic(w http.ResponseWriter, r *http.Request, e interface{}) {
+	if e == nil {
+		return
+	}
+	err := utils.Errorf("%v", e)
+	requestID := r.Header.Get(RequestIDHeader)
+	if requestID == "" {
+		requestID = utils.RandomString(16)
+	}
+	Log.Errorf("Panic handling %v %v, request id %v: %v\n%v", r.Method, r.URL, requestID, e, err.GetStack())
+	if PanicReporter != nil {
+		PanicReporter(r, requestID, err)
+	}
+	if hw, ok := w.(headerWriter); ok && hw.HeaderWritten() {
+		return
+	}
+	w.Header().Set(RequestIDHeader, requestID)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, "Internal server error, request id %v", requestID)
+}
+
+/*
+Recover wraps h so that panics are recovered, logged, reported to PanicReporter and responded to with a 500 status.
+
+Handle already does this for handlers using it.
+
+h gets the ResponseWriter wrapped in a DefaultMemorableResponseWriter, which forwards Flush and Hijack to the original one.
+*/
+func Recover(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(headerWriter); !ok {
+			w = &DefaultMemorableResponseWriter{
+				ResponseWriter: w,
+				startedAt:      time.Now(),
+			}
+		}
+		defer func() {
+			recoverPanic(w, r, recover())
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,86 @@
+package httpcontext
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+/*
+Server wraps an http.Server and keeps track of the requests currently being handled,
+so that Shutdown can drain them before the process exits.
+
+Unlike http.Server.Shutdown on its own, this also waits for requests on hijacked connections, and for requests handled
+by Track wrapped handlers served elsewhere.
+*/
+type Server struct {
+	http.Server
+	lock     sync.Mutex
+	inFlight int
+	draining bool
+	drained  chan struct{}
+}
+
+/*
+NewServer returns a Server listening on addr, tracking every request handled by handler.
+*/
+func NewServer(addr string, handler http.Handler) (result *Server) {
+	result = &Server{}
+	result.Addr = addr
+	result.Handler = result.Track(handler)
+	return
+}
+
+/*
+Track will wrap h so that the requests it handles are counted as in flight until they return.
+
+Requests arriving after Shutdown has been called will receive a 503 status.
+*/
+func (self *Server) Track(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		self.lock.Lock()
+		if self.draining {
+			self.lock.Unlock()
+			w.Header().Set("Connection", "close")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		self.inFlight++
+		self.lock.Unlock()
+		defer func() {
+			self.lock.Lock()
+			defer self.lock.Unlock()
+			self.inFlight--
+			if self.draining && self.inFlight == 0 {
+				close(self.drained)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+/*
+Shutdown will stop accepting new requests and wait for the tracked requests in flight to finish,
+or for ctx to be done, whichever happens first.
+*/
+func (self *Server) Shutdown(ctx context.Context) (err error) {
+	self.lock.Lock()
+	if !self.draining {
+		self.draining = true
+		self.drained = make(chan struct{})
+		if self.inFlight == 0 {
+			close(self.drained)
+		}
+	}
+	drained := self.drained
+	self.lock.Unlock()
+	if err = self.Server.Shutdown(ctx); err != nil {
+		return
+	}
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	return
+}
@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 
 	"time"
 
@@ -19,7 +21,21 @@ import (
 
 const (
 	APIVersionHeader = "X-API-Version"
-	RespondMarshal   = "respond"
+)
+
+/*
+The well known reasons passed as the last argument to BeforeMarshal functions taking three arguments.
+
+BeforeMarshal functions doing expensive work only needed in API responses, like fetching denormalized data,
+should skip it unless the reason is RespondMarshal.
+*/
+const (
+	// RespondMarshal is used when marshalling API responses.
+	RespondMarshal = "respond"
+	// IndexMarshal is used when marshalling for search indexes.
+	IndexMarshal = "index"
+	// BigQueryMarshal is used when marshalling for BigQuery, and matches what utils.Time looks for.
+	BigQueryMarshal = "bigquery"
 )
 
 func APIVersionMatcher(minAPIVersion, maxAPIVersion int) mux.MatcherFunc {
@@ -110,20 +126,193 @@ func (self *DefaultJSONContext) APIVersion() int {
 type Resp struct {
 	Status int
 	Body   interface{}
+	// Cache declares how the response may be cached, defaulting to DefaultCacheControl.
+	Cache *CacheControl
+}
+
+/*
+CacheControl describes how a response may be cached, and is translated into Cache-Control and Expires headers.
+*/
+type CacheControl struct {
+	// NoStore forbids storing the response anywhere, and overrides the other fields.
+	NoStore bool
+	// MaxAge is how long the response may be cached, zero meaning that it must be revalidated every time.
+	MaxAge time.Duration
+	// Public allows shared caches, like CDNs, to store the response.
+	Public bool
+	// Immutable promises that the response will never change during MaxAge.
+	Immutable bool
+}
+
+/*
+DefaultCacheControl returns the CacheControl of responses that don't declare any, which is NoStore for requests with an
+access token and nil (no headers at all) for other requests.
+*/
+var DefaultCacheControl = func(c JSONContext) *CacheControl {
+	if _, err := c.AccessToken(nil); err == nil {
+		return &CacheControl{NoStore: true}
+	}
+	return nil
+}
+
+func (self CacheControl) setHeaders(c JSONContext) {
+	if self.NoStore {
+		c.Resp().Header().Set("Cache-Control", "no-store")
+		return
+	}
+	parts := []string{"private"}
+	if self.Public {
+		parts[0] = "public"
+	}
+	parts = append(parts, fmt.Sprintf("max-age=%d", int64(self.MaxAge/time.Second)))
+	if self.Immutable {
+		parts = append(parts, "immutable")
+	}
+	c.Resp().Header().Set("Cache-Control", strings.Join(parts, ", "))
+	c.Resp().Header().Set("Expires", time.Now().Add(self.MaxAge).UTC().Format(http.TimeFormat))
 }
 
 func (self Resp) Error() string {
 	return fmt.Sprint(self.Body)
 }
 
+/*
+BeforeMarshalHook is run like a BeforeMarshal function on values of a registered type, with the same context, stack and arg,
+and target being a pointer to the value (if it is addressable).
+*/
+type BeforeMarshalHook func(c interface{}, target interface{}, stack []interface{}, arg interface{}) error
+
+var beforeMarshalHooks = map[reflect.Type]BeforeMarshalHook{}
+var beforeMarshalHooksLock sync.RWMutex
+
+/*
+RegisterBeforeMarshal will make the marshalling run hook for all values of type t (and pointers to them), which lets types
+from other packages get BeforeMarshal functions.
+
+If a value has a BeforeMarshal method of its own the method takes precedence, and the hook is not run.
+*/
+func RegisterBeforeMarshal(t reflect.Type, hook BeforeMarshalHook) {
+	beforeMarshalHooksLock.Lock()
+	defer beforeMarshalHooksLock.Unlock()
+	beforeMarshalHooks[t] = hook
+}
+
+/*
+beforeMarshalHook returns the registered hook for the type of val, and the target to run it on.
+*/
+func beforeMarshalHook(val reflect.Value) (hook BeforeMarshalHook, target reflect.Value) {
+	beforeMarshalHooksLock.RLock()
+	defer beforeMarshalHooksLock.RUnlock()
+	if len(beforeMarshalHooks) == 0 || !val.IsValid() {
+		return
+	}
+	if val.Kind() == reflect.Ptr {
+		if hook = beforeMarshalHooks[val.Type().Elem()]; hook != nil && !val.IsNil() {
+			return hook, val
+		}
+		return nil, target
+	}
+	if hook = beforeMarshalHooks[val.Type()]; hook != nil {
+		if val.CanAddr() {
+			return hook, val.Addr()
+		}
+		return hook, val
+	}
+	return
+}
+
 /*
 MarshalJSON will recursively run any found `BeforeMarshal` functions on the content with arg and a stack of container instances, and then json marshal it.
 
 It will not recurse down further after a BeforeMarshal function has been found, but it will run all top level BeforeMarshal functions that it finds.
+
+Values without BeforeMarshal functions will get any BeforeMarshalHook registered for their type run instead.
 */
 func (self *DefaultJSONContext) MarshalJSON(c interface{}, body interface{}, arg interface{}) (result []byte, err error) {
+	return marshalWithHooks(self.marshalSyncLock, c, body, arg)
+}
+
+/*
+MarshalWithHooks will run the `BeforeMarshal` functions of body with c, arg and a stack of container instances,
+and then json marshal it, just like DefaultJSONContext.MarshalJSON does for responses.
+
+This lets code outside HTTP requests, like background jobs, produce the same JSON as the API responses.
+c must be assignable to the context argument of the BeforeMarshal functions, and arg should be one of the
+well known reasons, like IndexMarshal or BigQueryMarshal, so that the functions can skip work not needed for it.
+*/
+func MarshalWithHooks(c interface{}, body interface{}, arg interface{}) (result []byte, err error) {
+	return marshalWithHooks(&utils.SyncLock{}, c, body, arg)
+}
+
+var (
+	// SlowMarshalHooksThreshold is the total time spent in BeforeMarshal functions and hooks during one marshalling
+	// above which a summary of the slowest types is logged.
+	SlowMarshalHooksThreshold = time.Second
+	// SlowMarshalHooksTop is the number of types in the summary.
+	SlowMarshalHooksTop = 5
+)
+
+type hookTiming struct {
+	typ   reflect.Type
+	count int
+	total time.Duration
+}
+
+type hookTimingsByTotal []*hookTiming
+
+func (self hookTimingsByTotal) Len() int           { return len(self) }
+func (self hookTimingsByTotal) Less(i, j int) bool { return self[i].total > self[j].total }
+func (self hookTimingsByTotal) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+/*
+hookTimings accumulates the time spent in BeforeMarshal functions and hooks per type.
+*/
+type hookTimings struct {
+	total   time.Duration
+	perType map[reflect.Type]*hookTiming
+}
+
+func (self *hookTimings) add(typ reflect.Type, d time.Duration) {
+	self.total += d
+	if self.perType == nil {
+		self.perType = map[reflect.Type]*hookTiming{}
+	}
+	timing, found := self.perType[typ]
+	if !found {
+		timing = &hookTiming{typ: typ}
+		self.perType[typ] = timing
+	}
+	timing.count++
+	timing.total += d
+}
+
+/*
+report logs the SlowMarshalHooksTop slowest types if the total time exceeds SlowMarshalHooksThreshold.
+*/
+func (self *hookTimings) report() {
+	if self.total <= SlowMarshalHooksThreshold {
+		return
+	}
+	sorted := make(hookTimingsByTotal, 0, len(self.perType))
+	for _, timing := range self.perType {
+		sorted = append(sorted, timing)
+	}
+	sort.Sort(sorted)
+	if len(sorted) > SlowMarshalHooksTop {
+		sorted = sorted[:SlowMarshalHooksTop]
+	}
+	summary := make([]string, len(sorted))
+	for index, timing := range sorted {
+		summary[index] = fmt.Sprintf("%v: %v calls taking %v", timing.typ, timing.count, timing.total)
+	}
+	httpcontext.Log.Warningf("BeforeMarshal functions took %v in total, slowest types: %v", self.total, strings.Join(summary, ", "))
+}
+
+func marshalWithHooks(marshalSyncLock *utils.SyncLock, c interface{}, body interface{}, arg interface{}) (result []byte, err error) {
 	// declare a function that recursively will run itself
 	var runRecursive func(reflect.Value, reflect.Value) error
+	timings := &hookTimings{}
+	defer timings.report()
 
 	cVal := reflect.ValueOf(c)
 	contextType := reflect.TypeOf((*JSONContext)(nil)).Elem()
@@ -139,7 +328,7 @@ func (self *DefaultJSONContext) MarshalJSON(c interface{}, body interface{}, arg
 		fun := val.MethodByName("BeforeMarshal")
 		if fun.IsValid() {
 			// make sure we don't run BeforeMarshal on any other things at the same time, at least in this context.
-			return self.marshalSyncLock.Sync(val.Interface(), func() (err error) {
+			return marshalSyncLock.Sync(val.Interface(), func() (err error) {
 				// Validate BeforeMarshal takes something that implements JSONContext
 				if err = utils.ValidateFuncInput(fun.Interface(), []reflect.Type{contextType, stackType}); err != nil {
 					if err = utils.ValidateFuncInput(fun.Interface(), []reflect.Type{contextType, stackType, reflect.TypeOf(arg)}); err != nil {
@@ -161,8 +350,9 @@ func (self *DefaultJSONContext) MarshalJSON(c interface{}, body interface{}, arg
 				// run the actual BeforeMarshal
 				res := fun.Call(args)
 
+				timings.add(val.Type(), time.Now().Sub(timer))
 				if time.Now().Sub(timer) > (500 * time.Millisecond) {
-					log.Printf("BeforeMarshal for %s is slow, took: %v", val.Type(), time.Now().Sub(timer))
+					httpcontext.Log.Warningf("BeforeMarshal for %s is slow, took: %v", val.Type(), time.Now().Sub(timer))
 				}
 
 				if !res[0].IsNil() {
@@ -171,8 +361,20 @@ func (self *DefaultJSONContext) MarshalJSON(c interface{}, body interface{}, arg
 				return
 			})
 		}
+		// Try run a registered BeforeMarshalHook, if we didn't find a BeforeMarshal func on the val itself
+		if hook, target := beforeMarshalHook(val); hook != nil {
+			return marshalSyncLock.Sync(target.Interface(), func() (err error) {
+				timer := time.Now()
+				err = hook(c, target.Interface(), stack.Interface().([]interface{}), arg)
+				timings.add(val.Type(), time.Now().Sub(timer))
+				if time.Now().Sub(timer) > (500 * time.Millisecond) {
+					httpcontext.Log.Warningf("BeforeMarshal hook for %s is slow, took: %v", val.Type(), time.Now().Sub(timer))
+				}
+				return
+			})
+		}
 
-		// Try do recursion on these types, if we didn't find a BeforeMarshal func on the val itself
+		// Try do recursion on these types, if we didn't find a BeforeMarshal func or hook for the val itself
 		switch val.Kind() {
 		case reflect.Ptr, reflect.Interface:
 			if val.IsNil() {
@@ -220,10 +422,16 @@ func (self *DefaultJSONContext) MarshalJSON(c interface{}, body interface{}, arg
 	return
 }
 
-func respond(c JSONContext, status int, body interface{}) (err error) {
+func respond(c JSONContext, status int, body interface{}, cache *CacheControl) (err error) {
 	if body != nil {
 		c.Resp().Header().Set("Content-Type", "application/json; charset=UTF-8")
 	}
+	if cache == nil {
+		cache = DefaultCacheControl(c)
+	}
+	if cache != nil {
+		cache.setHeaders(c)
+	}
 	// This timestamp is to be used by Tyson as an authoritative source of time, to compensate for broken
 	// clocks in devices.
 	t := time.Now().UTC()
@@ -244,7 +452,7 @@ func respond(c JSONContext, status int, body interface{}) (err error) {
 }
 
 func (self Resp) Respond(c httpcontext.HTTPContext) (err error) {
-	return respond(c.(JSONContext), self.Status, self.Body)
+	return respond(c.(JSONContext), self.Status, self.Body, self.Cache)
 }
 
 type JSONError struct {
@@ -256,17 +464,37 @@ func (self JSONError) GetStatus() int {
 }
 
 func (self JSONError) Respond(c httpcontext.HTTPContext) (err error) {
-	return respond(c.(JSONContext), self.Status, self.Body)
+	return respond(c.(JSONContext), self.Status, self.Body, nil)
 }
 
 func NewError(status int, body interface{}, info string, cause error) (result JSONError) {
 	return JSONError{httpcontext.NewError(status, body, info, cause)}
 }
 
+/*
+ValidationCode is a stable machine readable code for a validation failure, for clients to map to localized messages.
+*/
+type ValidationCode string
+
+const (
+	// Standard validation codes, to be used consistently across handlers
+	CodeRequired      ValidationCode = "required"
+	CodeTooLong       ValidationCode = "too_long"
+	CodeInvalidFormat ValidationCode = "invalid_format"
+	CodeOutOfRange    ValidationCode = "out_of_range"
+)
+
+var ValidationCodes = utils.NewEnumValidator("ValidationCode", string(CodeRequired), string(CodeTooLong), string(CodeInvalidFormat), string(CodeOutOfRange))
+
+func (self ValidationCode) Validate() error {
+	return ValidationCodes.Validate(string(self))
+}
+
 type field struct {
-	Message string `json:"message"`
-	Code    int    `json:"code"`
-	Cause   error  `json:"-"`
+	Message        string         `json:"message"`
+	Code           int            `json:"code"`
+	ValidationCode ValidationCode `json:"validation_code,omitempty"`
+	Cause          error          `json:"-"`
 }
 
 type ValidationError struct {
@@ -284,15 +512,11 @@ func (self ValidationError) GetStatus() int {
 	return self.Status
 }
 
-func (self *ValidationError) AddField(fieldName, message string, code int, cause error, status int) *ValidationError {
+func (self *ValidationError) addField(fieldName string, f field, status int) *ValidationError {
 	if self == nil {
 		return &ValidationError{
 			Fields: map[string]field{
-				fieldName: {
-					Message: message,
-					Code:    code,
-					Cause:   cause,
-				},
+				fieldName: f,
 			},
 			Status: status,
 		}
@@ -300,15 +524,48 @@ func (self *ValidationError) AddField(fieldName, message string, code int, cause
 	if self.Fields == nil {
 		self.Fields = make(map[string]field)
 	}
-	self.Fields[fieldName] = field{
+	self.Fields[fieldName] = f
+	if status > self.Status {
+		self.Status = status
+	}
+	return self
+}
+
+func (self *ValidationError) AddField(fieldName, message string, code int, cause error, status int) *ValidationError {
+	return self.addField(fieldName, field{
 		Message: message,
 		Code:    code,
 		Cause:   cause,
+	}, status)
+}
+
+/*
+AddCode will add a field failing validation with validationCode instead of a message, so that clients can localize it.
+
+It panics if validationCode is not one of ValidationCodes.
+*/
+func (self *ValidationError) AddCode(fieldName string, validationCode ValidationCode, cause error, status int) *ValidationError {
+	if err := validationCode.Validate(); err != nil {
+		panic(err)
 	}
-	if status > self.Status {
-		self.Status = status
+	return self.addField(fieldName, field{
+		ValidationCode: validationCode,
+		Cause:          cause,
+	}, status)
+}
+
+/*
+Validate will run f with an empty ValidationError for it to add fields to, and return it if any fields were added, or nil if none were.
+
+The status of the returned ValidationError is the highest status of the added fields, just like with AddField.
+*/
+func Validate(f func(v *ValidationError)) (err error) {
+	v := &ValidationError{}
+	f(v)
+	if len(v.Fields) > 0 {
+		err = v
 	}
-	return self
+	return
 }
 
 func (self ValidationError) Error() string {
@@ -343,6 +600,113 @@ func Handle(c JSONContext, f func() (Resp, error), minAPIVersion, maxAPIVersion
 	}, scopes...)
 }
 
+/*
+VersionSunset describes a graceful deprecation of old API versions of a route.
+
+Requests for versions below DeprecatedBelow are still served, but get a Warning header, and a Sunset header if Sunset is set.
+Requests for versions below HardMinimum get a 426 Upgrade Required.
+*/
+type VersionSunset struct {
+	DeprecatedBelow int
+	Sunset          time.Time
+	HardMinimum     int
+}
+
+/*
+Check will return a 426 error if c requests a version below HardMinimum, and add the deprecation headers if it requests a version
+below DeprecatedBelow.
+*/
+func (self VersionSunset) Check(c JSONContext) (err error) {
+	if self.HardMinimum != 0 && c.APIVersion() < self.HardMinimum {
+		err = NewError(426, fmt.Sprintf("X-API-Version header has to request API version at least %v", self.HardMinimum), fmt.Sprintf("Headers: %+v", c.Req().Header), nil)
+		return
+	}
+	if self.DeprecatedBelow != 0 && c.APIVersion() < self.DeprecatedBelow {
+		c.Resp().Header().Set("Warning", fmt.Sprintf("299 - \"API version %v is deprecated, use %v or greater\"", c.APIVersion(), self.DeprecatedBelow))
+		if !self.Sunset.IsZero() {
+			c.Resp().Header().Set("Sunset", self.Sunset.UTC().Format(http.TimeFormat))
+		}
+	}
+	return
+}
+
+/*
+Wrap will return a handler func running Check before f.
+*/
+func (self VersionSunset) Wrap(f func(c JSONContext) (Resp, error)) func(c JSONContext) (Resp, error) {
+	return func(c JSONContext) (resp Resp, err error) {
+		if err = self.Check(c); err != nil {
+			return
+		}
+		return f(c)
+	}
+}
+
+/*
+DataHandle will render the response of f in the format selected by the suffix of the request path, or by the Accept header
+when there is no suffix.
+
+JSON is rendered through Resp, so that BeforeMarshal functions are run on the values in the rows, and the other formats
+like httpcontext.DataHandle renders them.
+*/
+func DataHandle(c JSONContext, f func() (*httpcontext.DataResp, error), scopes ...string) {
+	httpcontext.Handle(c, func() (err error) {
+		resp, err := f()
+		if err != nil {
+			return
+		}
+		if resp.ContentType = httpcontext.DataContentType(c, true); resp.ContentType != httpcontext.ContentJSON {
+			return resp.Render(c)
+		}
+		if resp.Filename != "" {
+			c.Resp().Header().Set("Content-disposition", "attachment; filename="+resp.Filename)
+		}
+		var rows []dataRow
+		if resp.Data != nil {
+			for values := range resp.Data {
+				rows = append(rows, dataRow{
+					Headers: resp.Headers,
+					Values:  values,
+				})
+			}
+		}
+		return Resp{
+			Status: resp.Status,
+			Body:   rows,
+		}.Respond(c)
+	}, scopes...)
+}
+
+/*
+dataRow is a row of a httpcontext.DataResp, with the values exported so that BeforeMarshal functions are run on them, marshalled
+as an object from header to value like httpcontext.DataResp renders JSON.
+*/
+type dataRow struct {
+	Headers []string
+	Values  []interface{}
+}
+
+func (self dataRow) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{}
+	for index, header := range self.Headers {
+		m[header] = self.Values[index]
+	}
+	return json.Marshal(m)
+}
+
+/*
+DataHandlerFunc creates an http.Handler out of a function that takes a JSONContext and returns a *httpcontext.DataResp, rendered
+using DataHandle.
+*/
+func DataHandlerFunc(f func(c JSONContext) (*httpcontext.DataResp, error), scopes ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := NewJSONContext(httpcontext.NewHTTPContext(w, r))
+		DataHandle(c, func() (*httpcontext.DataResp, error) {
+			return f(c)
+		}, scopes...)
+	})
+}
+
 func HandlerFunc(f func(c JSONContext) (Resp, error), minAPIVersion, maxAPIVersion int, scopes ...string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c := NewJSONContext(httpcontext.NewHTTPContext(w, r))
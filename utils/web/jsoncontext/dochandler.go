@@ -3,12 +3,15 @@ package jsoncontext
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net/http"
 	"reflect"
 	"regexp"
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -85,7 +88,10 @@ var DefaultTypeTemplateContent = `
 {{if .Type.Scopes}}
 <tr><td>Scopes</td><td>{{.Type.Scopes}}</td></tr>
 {{end}}
-{{if .Type.Elem}}
+{{if .Type.Key}}
+<tr><td valign="top">Key</td><td>{{RenderSubType .Type.Key .Stack}}</td></tr>
+<tr><td valign="top">Value</td><td>{{RenderSubType .Type.Elem .Stack}}</td></tr>
+{{else if .Type.Elem}}
 <tr><td valign="top">Element</td><td>{{RenderSubType .Type.Elem .Stack}}</td></tr>
 {{end}}
 {{ $stack := .Stack }}
@@ -97,16 +103,22 @@ var DefaultTypeTemplateContent = `
 `
 
 var DefaultEndpointTemplateContent = `
-<div class="panel panel-default">
+<div class="panel {{if .Deprecated}}panel-warning{{else}}panel-default{{end}}">
   <div class="panel-heading" data-toggle="collapse" href="#collapse-{{UUID}}">
     <h4 class="panel-title">
       <a>
-        {{.Methods}} {{.Path}}
+        {{if .Deprecated}}<del>{{.Methods}} {{.Path}}</del> <span class="label label-warning">Deprecated</span>{{else}}{{.Methods}} {{.Path}}{{end}}
       </a>
     </h4>
   </div>
   <div id="collapse-{{UUID}}" class="panel-collapse collapse">
     <div class="panel-body">
+			{{if .Deprecated}}
+			<div class="alert alert-warning">
+			<strong>Deprecated.</strong>{{if not .Sunset.IsZero}} Will be removed after {{.Sunset.Format "2006-01-02"}}.{{end}}
+			{{if .DeprecationMessage}}{{.DeprecationMessage}}{{end}}
+			</div>
+			{{end}}
 			{{if .Comment}}
 			<p style="font-size: large;">{{.Comment}}</p>
 			{{end}}
@@ -201,6 +213,9 @@ type DocumentedRoutes []DocumentedRoute
 
 var routes = DocumentedRoutes{}
 
+// routesGeneration is incremented every time routes changes, to invalidate the docs rendered by DocHandler.
+var routesGeneration int64
+
 func (a DocumentedRoutes) Len() int           { return len(a) }
 func (a DocumentedRoutes) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a DocumentedRoutes) Less(i, j int) bool { return a[i].GetSortString() < a[j].GetSortString() }
@@ -214,12 +229,42 @@ type JSONType struct {
 	Type        string
 	Fields      map[string]*JSONType
 	Scopes      []string
+	Key         *JSONType
 	Elem        *JSONType
 	Comment     string
 }
 
+type jsonTypeCacheKey struct {
+	in             bool
+	t              reflect.Type
+	filterOnScopes bool
+	scopeContexts  string
+	relevantScopes string
+}
+
+var jsonTypeCache = map[jsonTypeCacheKey]*JSONType{}
+var jsonTypeCacheLock sync.Mutex
+
+/*
+newJSONType will return the JSONType for t, cached so that types used by many routes are only reflected over once.
+
+The cached JSONTypes are shared, so they must not be modified.
+*/
 func newJSONType(in bool, t reflect.Type, filterOnScopes bool, scopeContexts []string, relevantScopes ...string) (result *JSONType) {
-	return newJSONTypeLoopProtector(nil, in, t, filterOnScopes, scopeContexts, relevantScopes...)
+	cacheKey := jsonTypeCacheKey{
+		in:             in,
+		t:              t,
+		filterOnScopes: filterOnScopes,
+		scopeContexts:  strings.Join(scopeContexts, "|"),
+		relevantScopes: strings.Join(relevantScopes, "|"),
+	}
+	jsonTypeCacheLock.Lock()
+	defer jsonTypeCacheLock.Unlock()
+	if result = jsonTypeCache[cacheKey]; result == nil {
+		result = newJSONTypeLoopProtector(nil, in, t, filterOnScopes, scopeContexts, relevantScopes...)
+		jsonTypeCache[cacheKey] = result
+	}
+	return
 }
 
 /*
@@ -319,6 +364,11 @@ func newJSONTypeLoopProtector(seen []reflect.Type, in bool, t reflect.Type, filt
 	case reflect.Slice:
 		result.Type = "Array"
 		result.Elem = newJSONTypeLoopProtector(append(seen, t), in, t.Elem(), filterOnScopes, scopeContexts, relevantScopes...)
+	case reflect.Map:
+		// maps are encoded as JSON objects, with the keys as strings
+		result.Type = "Map"
+		result.Key = newJSONTypeLoopProtector(append(seen, t), in, t.Key(), filterOnScopes, scopeContexts, relevantScopes...)
+		result.Elem = newJSONTypeLoopProtector(append(seen, t), in, t.Elem(), filterOnScopes, scopeContexts, relevantScopes...)
 	default:
 		result.Type = t.Name()
 	}
@@ -334,6 +384,20 @@ type DefaultDocumentedRoute struct {
 	In            *JSONType
 	Out           *JSONType
 	Comment       string
+	// Deprecated routes are flagged in the docs, along with their optional Sunset and DeprecationMessage.
+	Deprecated         bool
+	Sunset             time.Time
+	DeprecationMessage string
+}
+
+/*
+Deprecate will flag the route as deprecated in the documentation, to be removed after sunset (unless zero) for the reason in message.
+*/
+func (self *DefaultDocumentedRoute) Deprecate(sunset time.Time, message string) *DefaultDocumentedRoute {
+	self.Deprecated = true
+	self.Sunset = sunset
+	self.DeprecationMessage = message
+	return self
 }
 
 func (self *DefaultDocumentedRoute) GetScopes() []string {
@@ -363,6 +427,7 @@ Remember will record the doc and make sure it shows up in the documentation.
 */
 func Remember(doc DocumentedRoute) {
 	routes = append(routes, doc)
+	atomic.AddInt64(&routesGeneration, 1)
 }
 
 /*
@@ -475,92 +540,119 @@ func Document(fIn interface{}, path string, methods string, minAPIVersion, maxAP
 	return
 }
 
+/*
+example will render an example of the provided JSONType, containing only the fields of the type.
+*/
+func example(r JSONType) (result string, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			result = fmt.Sprintf("%v\n%s", e, utils.Stack())
+		}
+	}()
+	x := utils.Example(r.ReflectType)
+	b, err := json.MarshalIndent(x, "", "  ")
+	if err != nil {
+		return
+	}
+	if len(r.Fields) > 0 {
+		var i interface{}
+		if err = json.Unmarshal(b, &i); err != nil {
+			return
+		}
+		if m, ok := i.(map[string]interface{}); ok {
+			newMap := map[string]interface{}{}
+			for k, v := range m {
+				if _, found := r.Fields[k]; found {
+					newMap[k] = v
+				}
+			}
+			if b, err = json.MarshalIndent(newMap, "", "  "); err != nil {
+				return
+			}
+		}
+	}
+	result = string(b)
+	return
+}
+
 /*
 DocHandler will return a handler that renders the documentation for all routes registerd with DocHandle.
 
 The resulting func will do this by going through each route in DocumentedRoutes and render the endpoint
 using the provided template, providing it template functions to render separate endpoints, types, sub types
 and examples of types.
+
+The rendered documentation is cached until the routes change.
 */
 func DocHandler(templ *template.Template) http.Handler {
+	var cacheLock sync.Mutex
+	var cached []byte
+	cachedGeneration := int64(-1)
 	return httpcontext.HandlerFunc(func(c httpcontext.HTTPContext) (err error) {
 		c.Resp().Header().Set("Content-Type", "text/html; charset=UTF-8")
-		// we define a func to render a type
-		// it basically just executes the "TypeTemplate" with the provided
-		// stack to avoid infinite recursion
-		renderType := func(t JSONType, stack []string) (result string, err error) {
-			// if the type is already mentioned in one of the parents we have already mentioned,
-			// bail
-			for _, parent := range stack {
-				if parent != "" && parent == t.ReflectType.Name() {
-					result = fmt.Sprintf("[loop protector enabled, render stack: %v]", stack)
-					return
-				}
-			}
-			stack = append(stack, t.ReflectType.Name())
+		cacheLock.Lock()
+		defer cacheLock.Unlock()
+		generation := atomic.LoadInt64(&routesGeneration)
+		if cached == nil || cachedGeneration != generation {
 			buf := &bytes.Buffer{}
-			// then execute the TypeTemplate with this type and this stack
-			if err = templ.ExecuteTemplate(buf, "TypeTemplate", map[string]interface{}{
-				"Type":  t,
-				"Stack": stack,
-			}); err != nil {
+			if err = renderDocs(templ, buf); err != nil {
 				return
 			}
-			result = buf.String()
-			return
+			cached, cachedGeneration = buf.Bytes(), generation
 		}
+		_, err = c.Resp().Write(cached)
+		return
+	})
+}
 
-		// routes are documented alphabetically
-		sort.Sort(routes)
-		// define all the functions that we left empty earlier
-		err = templ.Funcs(map[string]interface{}{
-			"RenderEndpoint": func(r DocumentedRoute) (string, error) {
-				return r.Render(templ.Lookup("EndpointTemplate"))
-			},
-			"RenderSubType": func(t JSONType, stack []string) (result string, err error) {
-				return renderType(t, stack)
-			},
-			"RenderType": func(t JSONType) (result string, err error) {
-				return renderType(t, nil)
-			},
-			"First": first,
-			"Example": func(r JSONType) (result string, err error) {
-				// this will render an example of the provided JSONType
-				defer func() {
-					if e := recover(); e != nil {
-						result = fmt.Sprintf("%v\n%s", e, utils.Stack())
-					}
-				}()
-				x := utils.Example(r.ReflectType)
-				b, err := json.MarshalIndent(x, "", "  ")
-				if err != nil {
-					return
-				}
-				if len(r.Fields) > 0 {
-					var i interface{}
-					if err = json.Unmarshal(b, &i); err != nil {
-						return
-					}
-					if m, ok := i.(map[string]interface{}); ok {
-						newMap := map[string]interface{}{}
-						for k, v := range m {
-							if _, found := r.Fields[k]; found {
-								newMap[k] = v
-							}
-						}
-						if b, err = json.MarshalIndent(newMap, "", "  "); err != nil {
-							return
-						}
-					}
-				}
-				result = string(b)
+/*
+renderDocs will render the documentation for all routes to w using templ.
+*/
+func renderDocs(templ *template.Template, w io.Writer) (err error) {
+	// we define a func to render a type
+	// it basically just executes the "TypeTemplate" with the provided
+	// stack to avoid infinite recursion
+	renderType := func(t JSONType, stack []string) (result string, err error) {
+		// if the type is already mentioned in one of the parents we have already mentioned,
+		// bail
+		for _, parent := range stack {
+			if parent != "" && parent == t.ReflectType.Name() {
+				result = fmt.Sprintf("[loop protector enabled, render stack: %v]", stack)
 				return
-			},
-		}).Execute(c.Resp(), map[string]interface{}{
-			"Endpoints": routes,
-		})
+			}
+		}
+		stack = append(stack, t.ReflectType.Name())
+		buf := &bytes.Buffer{}
+		// then execute the TypeTemplate with this type and this stack
+		if err = templ.ExecuteTemplate(buf, "TypeTemplate", map[string]interface{}{
+			"Type":  t,
+			"Stack": stack,
+		}); err != nil {
+			return
+		}
+		result = buf.String()
 		return
+	}
+
+	// routes are documented alphabetically
+	sort.Sort(routes)
+	// define all the functions that we left empty earlier
+	err = templ.Funcs(map[string]interface{}{
+		"RenderEndpoint": func(r DocumentedRoute) (string, error) {
+			return r.Render(templ.Lookup("EndpointTemplate"))
+		},
+		"RenderSubType": func(t JSONType, stack []string) (result string, err error) {
+			return renderType(t, stack)
+		},
+		"RenderType": func(t JSONType) (result string, err error) {
+			return renderType(t, nil)
+		},
+		"First":   first,
+		"Example": example,
+	}).Execute(w, map[string]interface{}{
+		"Endpoints": routes,
 	})
+	return
 }
 
 /*
@@ -568,10 +660,66 @@ DocHandle will register f as handler for path, method, api versions and scopes i
 
 It will also reflectively go through the parameters and return values of f, and register those in
 the DocumentedRoutes variable.
+
+The returned route can be used to further document the route, e.g. using Deprecate.
 */
-func DocHandle(router *mux.Router, f interface{}, path string, method string, minAPIVersion, maxAPIVersion int, scopes ...string) {
+func DocHandle(router *mux.Router, f interface{}, path string, method string, minAPIVersion, maxAPIVersion int, scopes ...string) (doc *DefaultDocumentedRoute) {
 	doc, fu := Document(f, path, method, minAPIVersion, maxAPIVersion, scopes...)
 	Remember(doc)
 	methods := strings.Split(method, "|")
 	router.Path(path).Methods(methods...).MatcherFunc(APIVersionMatcher(minAPIVersion, maxAPIVersion)).Handler(HandlerFunc(fu, minAPIVersion, maxAPIVersion, scopes...))
+	return
+}
+
+/*
+SunsetDocHandle will register f like DocHandle, but also deprecate old API versions as described by sunset.
+
+minAPIVersion should be 0 or at most sunset.HardMinimum, or the old versions will never reach the handler.
+*/
+func SunsetDocHandle(router *mux.Router, sunset VersionSunset, f interface{}, path string, method string, minAPIVersion, maxAPIVersion int, scopes ...string) (doc *DefaultDocumentedRoute) {
+	doc, fu := Document(f, path, method, minAPIVersion, maxAPIVersion, scopes...)
+	Remember(doc)
+	methods := strings.Split(method, "|")
+	router.Path(path).Methods(methods...).MatcherFunc(APIVersionMatcher(minAPIVersion, maxAPIVersion)).Handler(HandlerFunc(sunset.Wrap(fu), minAPIVersion, maxAPIVersion, scopes...))
+	return
+}
+
+/*
+DocumentData returns a route documenting tabular data at path, method and scopes, rendered like DataHandle does.
+*/
+func DocumentData(path string, method string, scopes ...string) *DefaultDocumentedRoute {
+	return &DefaultDocumentedRoute{
+		Path:    path,
+		Methods: strings.Split(method, "|"),
+		Scopes:  scopes,
+		Comment: fmt.Sprintf("Tabular data, rendered as JSON, or depending on the path suffix or Accept header as %v.", DataFormats),
+	}
+}
+
+// DataFormats are the path suffixes DataDocHandle routes, selecting the format of the rendered data.
+var DataFormats = []string{"json", "jjson", "csv", "html"}
+
+/*
+DataPaths returns path, and path with each of the DataFormats as suffix.
+*/
+func DataPaths(path string) (result []string) {
+	result = []string{path}
+	for _, format := range DataFormats {
+		result = append(result, path+"."+format)
+	}
+	return
+}
+
+/*
+DataDocHandle will register f as handler for path (with and without any of the DataFormats suffixes), method and scopes in router,
+serving the same rows as JSON or any of the other formats using DataHandle, and document the route once using DocumentData.
+*/
+func DataDocHandle(router *mux.Router, f func(c JSONContext) (*httpcontext.DataResp, error), path string, method string, scopes ...string) (doc *DefaultDocumentedRoute) {
+	doc = DocumentData(path, method, scopes...)
+	Remember(doc)
+	handler := DataHandlerFunc(f, scopes...)
+	for _, dataPath := range DataPaths(path) {
+		router.Path(dataPath).Methods(doc.Methods...).Handler(handler)
+	}
+	return
 }
@@ -0,0 +1,145 @@
+package jsoncontext
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zond/sybutils/utils/json"
+	"github.com/zond/sybutils/utils/web/httpcontext"
+)
+
+const postmanSchema = "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"
+
+var muxVarPattern = regexp.MustCompile("^\\{([^:}]+)(:.*)?\\}$")
+
+type PostmanInfo struct {
+	Name   string `json:"name"`
+	Schema string `json:"schema"`
+}
+
+type PostmanHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type PostmanURL struct {
+	Raw  string   `json:"raw"`
+	Host []string `json:"host"`
+	Path []string `json:"path"`
+}
+
+type PostmanBody struct {
+	Mode string `json:"mode"`
+	Raw  string `json:"raw"`
+}
+
+type PostmanRequest struct {
+	Method string          `json:"method"`
+	Header []PostmanHeader `json:"header"`
+	URL    PostmanURL      `json:"url"`
+	Body   *PostmanBody    `json:"body,omitempty"`
+}
+
+type PostmanItem struct {
+	Name    string         `json:"name"`
+	Request PostmanRequest `json:"request"`
+}
+
+/*
+PostmanCollection is a Postman v2.1 collection of documented routes.
+*/
+type PostmanCollection struct {
+	Info PostmanInfo   `json:"info"`
+	Item []PostmanItem `json:"item"`
+}
+
+/*
+NewPostmanCollection will return a Postman collection named name, with one request per method of each route registered with
+DocHandle or Remember.
+
+The requests use the Postman variables {{host}} for the server and {{token}} for the access token of routes requiring scopes.
+Requests for versioned routes send the minimum API version of the route in the X-API-Version header, so that APIVersionMatcher
+lets them through.
+*/
+func NewPostmanCollection(name string) (result *PostmanCollection, err error) {
+	result = &PostmanCollection{
+		Info: PostmanInfo{
+			Name:   name,
+			Schema: postmanSchema,
+		},
+		Item: []PostmanItem{},
+	}
+	sort.Sort(routes)
+	for _, route := range routes {
+		docRoute, ok := route.(*DefaultDocumentedRoute)
+		if !ok {
+			continue
+		}
+		path := []string{}
+		for _, part := range strings.Split(strings.Trim(docRoute.Path, "/"), "/") {
+			if match := muxVarPattern.FindStringSubmatch(part); match != nil {
+				part = ":" + match[1]
+			}
+			path = append(path, part)
+		}
+		for _, method := range docRoute.Methods {
+			item := PostmanItem{
+				Name: method + " " + docRoute.Path,
+				Request: PostmanRequest{
+					Method: method,
+					Header: []PostmanHeader{},
+					URL: PostmanURL{
+						Raw:  "{{host}}/" + strings.Join(path, "/"),
+						Host: []string{"{{host}}"},
+						Path: path,
+					},
+				},
+			}
+			if len(docRoute.Scopes) > 0 {
+				item.Request.Header = append(item.Request.Header, PostmanHeader{
+					Key:   "Authorization",
+					Value: "Bearer {{token}}",
+				})
+			}
+			if docRoute.MinAPIVersion != 0 || docRoute.MaxAPIVersion != 0 {
+				item.Request.Header = append(item.Request.Header, PostmanHeader{
+					Key:   APIVersionHeader,
+					Value: strconv.Itoa(docRoute.MinAPIVersion),
+				})
+			}
+			if docRoute.In != nil {
+				item.Request.Header = append(item.Request.Header, PostmanHeader{
+					Key:   "Content-Type",
+					Value: "application/json",
+				})
+				body := &PostmanBody{
+					Mode: "raw",
+				}
+				if body.Raw, err = example(*docRoute.In); err != nil {
+					return
+				}
+				item.Request.Body = body
+			}
+			result.Item = append(result.Item, item)
+		}
+	}
+	return
+}
+
+/*
+PostmanHandler will return a handler that renders a Postman collection named name of all routes registered with DocHandle.
+*/
+func PostmanHandler(name string) http.Handler {
+	return httpcontext.HandlerFunc(func(c httpcontext.HTTPContext) (err error) {
+		collection, err := NewPostmanCollection(name)
+		if err != nil {
+			return
+		}
+		c.Resp().Header().Set("Content-Type", "application/json; charset=UTF-8")
+		c.Resp().Header().Set("Content-disposition", "attachment; filename="+name+".postman_collection.json")
+		return json.NewEncoder(c.Resp()).Encode(collection)
+	})
+}